@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	authTimeHeader      = "X-Ggfetch-Time"
+	authSignatureHeader = "X-Ggfetch-Signature"
+	// How far the time of a signed request may be from ours. Requests may be
+	// replayed within it, which peer requests tolerate.
+	authWindow = 30 * time.Second
+)
+
+// peerURL returns the base URL of a peer at host:port, with scheme, or
+// http if it's empty.
+func peerURL(scheme, addr string) string {
+	if scheme == "" {
+		scheme = "http"
+	}
+	return scheme + "://" + addr
+}
+
+// PeerAuth authenticates the traffic between peers, either by signing the
+// requests with a shared secret, or with mutual TLS, or both. With mutual
+// TLS the traffic is encrypted as well, and peers must present a
+// certificate signed by the CA.
+type PeerAuth struct {
+	secret []byte
+	server *tls.Config
+	client *tls.Config
+}
+
+// NewPeerAuth loads the secret and certificates of the cluster config.
+// Peer traffic is not authenticated if there are none.
+func NewPeerAuth(c ClusterConfig) (*PeerAuth, error) {
+	a := new(PeerAuth)
+	if c.SecretFile != "" {
+		secret, err := ioutil.ReadFile(c.SecretFile)
+		if err != nil {
+			return nil, err
+		}
+		if a.secret = bytes.TrimSpace(secret); len(a.secret) == 0 {
+			return nil, fmt.Errorf("empty secret in %s", c.SecretFile)
+		}
+	}
+	if c.CertFile != "" || c.KeyFile != "" || c.CAFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		pem, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		ca := x509.NewCertPool()
+		if !ca.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate in %s", c.CAFile)
+		}
+		// Clients of the API don't need a certificate, only peers do.
+		a.server = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			ClientCAs:    ca,
+			ClientAuth:   tls.VerifyClientCertIfGiven,
+		}
+		a.client = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			RootCAs:      ca,
+		}
+	}
+	return a, nil
+}
+
+// Enabled tells whether peer traffic is authenticated.
+func (a *PeerAuth) Enabled() bool {
+	return a.secret != nil || a.server != nil
+}
+
+// Scheme returns the scheme of the URLs of peers, https with mutual TLS.
+func (a *PeerAuth) Scheme() string {
+	if a.server != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// TLSConfig returns the config of the server, or nil without mutual TLS.
+func (a *PeerAuth) TLSConfig() *tls.Config {
+	return a.server
+}
+
+// Wrap returns a transport authenticating the requests made with t.
+func (a *PeerAuth) Wrap(t http.RoundTripper) http.RoundTripper {
+	if a.secret == nil {
+		return t
+	}
+	return signingTransport{a, t}
+}
+
+func (a *PeerAuth) sign(method, uri, timestamp string, body []byte) []byte {
+	mac := hmac.New(sha256.New, a.secret)
+	fmt.Fprintf(mac, "%s\n%s\n%s\n", method, uri, timestamp)
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+// Verify checks that a request comes from a peer.
+func (a *PeerAuth) Verify(r *http.Request) error {
+	if a.server != nil && (r.TLS == nil || len(r.TLS.VerifiedChains) == 0) {
+		return errors.New("peer certificate required")
+	}
+	if a.secret == nil {
+		return nil
+	}
+	timestamp := r.Header.Get(authTimeHeader)
+	t, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errors.New("request not signed")
+	}
+	if d := time.Since(time.Unix(t, 0)); d > authWindow || d < -authWindow {
+		return errors.New("request signed too long ago")
+	}
+	signature, err := hex.DecodeString(r.Header.Get(authSignatureHeader))
+	if err != nil {
+		return errors.New("bad signature")
+	}
+	var body []byte
+	if r.Body != nil {
+		if body, err = ioutil.ReadAll(r.Body); err != nil {
+			return err
+		}
+		r.Body.Close()
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	if !hmac.Equal(signature, a.sign(r.Method, r.RequestURI, timestamp, body)) {
+		return errors.New("bad signature")
+	}
+	return nil
+}
+
+// Protect rejects the requests to h not coming from a peer.
+func (a *PeerAuth) Protect(h http.Handler) http.Handler {
+	if !a.Enabled() {
+		return h
+	}
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		if err := a.Verify(request); err != nil {
+			http.Error(response, err.Error(), http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(response, request)
+	})
+}
+
+// localOnly rejects the requests to h not coming from this host, for
+// endpoints meant for its own hooks.
+func localOnly(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		host, _, _ := net.SplitHostPort(request.RemoteAddr)
+		if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+			http.Error(response, "local requests only", http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(response, request)
+	})
+}
+
+// signingTransport signs the requests with the shared secret.
+type signingTransport struct {
+	auth *PeerAuth
+	http.RoundTripper
+}
+
+func (t signingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		if body, err = ioutil.ReadAll(req.Body); err != nil {
+			return nil, err
+		}
+		req.Body.Close()
+	}
+	// Leave the original request alone.
+	signed := new(http.Request)
+	*signed = *req
+	signed.Header = make(http.Header)
+	for k, v := range req.Header {
+		signed.Header[k] = v
+	}
+	if body != nil {
+		signed.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	signed.Header.Set(authTimeHeader, timestamp)
+	signed.Header.Set(authSignatureHeader, hex.EncodeToString(t.auth.sign(req.Method, req.URL.RequestURI(), timestamp, body)))
+	return t.RoundTripper.RoundTrip(signed)
+}
+
+// stripPeerURL returns the host:port of the base URL of a peer.
+func stripPeerURL(u string) string {
+	if i := strings.Index(u, "://"); i >= 0 {
+		return u[i+3:]
+	}
+	return u
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	. "github.com/golang/groupcache"
+	pb "github.com/golang/groupcache/groupcachepb"
+	"github.com/golang/protobuf/proto"
+)
+
+// The batch protocol gets several keys from a peer in a single request.
+// The request is a POST to the base path, with a body of length-delimited
+// GetRequests. The response is a stream of results in the order they
+// complete, each made of the index of the key in the request, a status,
+// and a length-delimited payload: a GetResponse if the status is 200, or
+// an error message. All integers are uvarints.
+
+const (
+	// Most keys in a batch.
+	maxBatchSize = 128
+	// Most keys of a batch loaded at once.
+	batchConcurrency = 16
+	// Largest request in a batch, and largest value in its response.
+	maxRequestFrame = 64 << 10
+	maxValueFrame   = 1 << 30
+	// How long the first key of a batch waits for others. Batches are not
+	// otherwise limited, as a get may wait on nested gets to the same peer.
+	batchDelay = 2 * time.Millisecond
+)
+
+type batchResult struct {
+	err        error
+	peerFailed bool
+}
+
+type batchCall struct {
+	req  *pb.GetRequest
+	res  *pb.GetResponse
+	done chan batchResult
+	// Set once done has a result.
+	answered bool
+}
+
+func (c *batchCall) finish(err error, peerFailed bool) {
+	if !c.answered {
+		c.answered = true
+		c.done <- batchResult{err, peerFailed}
+	}
+}
+
+// batcher coalesces the concurrent requests to a peer into batches.
+type batcher struct {
+	transport func(Context) http.RoundTripper
+	url       string
+	timeout   time.Duration
+
+	mu    sync.Mutex
+	queue []*batchCall
+}
+
+// Get gets a key from the peer, in a batch with the other keys requested
+// meanwhile. It also tells whether an error is a failure of the peer itself.
+func (b *batcher) Get(in *pb.GetRequest, out *pb.GetResponse) (err error, peerFailed bool) {
+	c := &batchCall{req: in, res: out, done: make(chan batchResult, 1)}
+	b.mu.Lock()
+	b.queue = append(b.queue, c)
+	if len(b.queue) >= maxBatchSize {
+		b.flush()
+	} else if len(b.queue) == 1 {
+		time.AfterFunc(batchDelay, func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			b.flush()
+		})
+	}
+	b.mu.Unlock()
+	r := <-c.done
+	return r.err, r.peerFailed
+}
+
+// flush sends the keys queued, if any. It's called with the lock held.
+func (b *batcher) flush() {
+	if len(b.queue) == 0 {
+		return
+	}
+	go b.send(b.queue)
+	b.queue = nil
+}
+
+func (b *batcher) send(calls []*batchCall) {
+	err, peerFailed := b.roundTrip(calls)
+	if err == nil {
+		err = errors.New("no result in batch")
+	}
+	for _, c := range calls {
+		c.finish(err, peerFailed)
+	}
+}
+
+// roundTrip sends a batch, and finishes the calls as results come.
+func (b *batcher) roundTrip(calls []*batchCall) (err error, peerFailed bool) {
+	var body bytes.Buffer
+	for _, c := range calls {
+		msg, err := proto.Marshal(c.req)
+		if err != nil {
+			return err, false
+		}
+		writeUvarint(&body, uint64(len(msg)))
+		body.Write(msg)
+	}
+	req, err := http.NewRequest("POST", b.url, &body)
+	if err != nil {
+		return err, false
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req, conn := traceConn(req)
+	tr := http.DefaultTransport
+	if b.transport != nil {
+		tr = b.transport(nil)
+	}
+	client := &http.Client{Transport: tr, Timeout: b.timeout}
+	res, err := client.Do(req)
+	if err != nil {
+		return err, !conn.loading(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		// Draining peers refuse requests.
+		return fmt.Errorf("server returned: %v", res.Status), res.StatusCode == http.StatusServiceUnavailable
+	}
+	br := bufio.NewReader(res.Body)
+	for range calls {
+		index, err := binary.ReadUvarint(br)
+		if err != nil {
+			return fmt.Errorf("reading response body: %v", err), !conn.loading(err)
+		}
+		status, err := binary.ReadUvarint(br)
+		if err != nil {
+			return fmt.Errorf("reading response body: %v", err), !conn.loading(err)
+		}
+		payload, err := readFrame(br, maxValueFrame)
+		if err != nil {
+			return fmt.Errorf("reading response body: %v", err), !conn.loading(err)
+		}
+		if index >= uint64(len(calls)) || calls[index].answered {
+			return fmt.Errorf("bad index in batch: %d", index), true
+		}
+		c := calls[index]
+		if status != http.StatusOK {
+			c.finish(fmt.Errorf("server returned: %d %s", status, payload), false)
+			continue
+		}
+		if err := proto.Unmarshal(payload, c.res); err != nil {
+			c.finish(fmt.Errorf("decoding response body: %v", err), true)
+			continue
+		}
+		c.finish(nil, false)
+	}
+	return nil, false
+}
+
+// serveBatch serves a batch request, streaming the results as they come.
+func (p *PeersPool) serveBatch(w http.ResponseWriter, r *http.Request) {
+	var reqs []*pb.GetRequest
+	br := bufio.NewReader(r.Body)
+	for {
+		msg, err := readFrame(br, maxRequestFrame)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(reqs) == maxBatchSize {
+			http.Error(w, "batch too large", http.StatusBadRequest)
+			return
+		}
+		req := new(pb.GetRequest)
+		if err := proto.Unmarshal(msg, req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		reqs = append(reqs, req)
+	}
+	// Refuse the batch as a whole when draining.
+	for i, req := range reqs {
+		if !p.begin(req.GetGroup(), req.GetKey()) {
+			for _, started := range reqs[:i] {
+				p.end(started.GetGroup(), started.GetKey())
+			}
+			http.Error(w, "draining", http.StatusServiceUnavailable)
+			return
+		}
+	}
+	var ctx Context
+	if p.Context != nil {
+		ctx = p.Context(r)
+	}
+
+	type result struct {
+		index   int
+		status  int
+		payload []byte
+	}
+	results := make(chan result, len(reqs))
+	sem := make(chan struct{}, batchConcurrency)
+	for i, req := range reqs {
+		go func(i int, req *pb.GetRequest) {
+			defer p.end(req.GetGroup(), req.GetKey())
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			value, status, err := p.get(ctx, req.GetGroup(), req.GetKey())
+			if err != nil {
+				results <- result{i, status, []byte(err.Error())}
+				return
+			}
+			results <- result{i, http.StatusOK, value}
+		}(i, req)
+	}
+
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	flusher, _ := w.(http.Flusher)
+	var buf bytes.Buffer
+	for range reqs {
+		res := <-results
+		buf.Reset()
+		writeUvarint(&buf, uint64(res.index))
+		writeUvarint(&buf, uint64(res.status))
+		writeUvarint(&buf, uint64(len(res.payload)))
+		buf.Write(res.payload)
+		if _, err := w.Write(buf.Bytes()); err != nil {
+			// The peer is gone, let the gets complete anyway.
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+}
+
+func writeUvarint(w *bytes.Buffer, x uint64) {
+	var b [binary.MaxVarintLen64]byte
+	w.Write(b[:binary.PutUvarint(b[:], x)])
+}
+
+// readFrame reads a length-delimited frame of at most max bytes. It returns
+// io.EOF only if there are no more frames.
+func readFrame(br *bufio.Reader, max uint64) ([]byte, error) {
+	n, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, err
+	}
+	if n > max {
+		return nil, fmt.Errorf("frame too large: %d bytes", n)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(br, b); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return b, nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	pb "github.com/golang/groupcache/groupcachepb"
+	"github.com/golang/protobuf/proto"
+)
+
+func postBatch(p *PeersPool, body []byte) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("POST", defaultBasePath, bytes.NewReader(body)))
+	return w
+}
+
+func batchBody(t *testing.T, n int) []byte {
+	var body bytes.Buffer
+	for i := 0; i < n; i++ {
+		msg, err := proto.Marshal(&pb.GetRequest{Group: proto.String("nosuchgroup"), Key: proto.String("key")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeUvarint(&body, uint64(len(msg)))
+		body.Write(msg)
+	}
+	return body.Bytes()
+}
+
+func TestServeBatchRejects(t *testing.T) {
+	p := &PeersPool{basePath: defaultBasePath}
+	if w := postBatch(p, batchBody(t, 1)); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("batch served while not enabled: %d", w.Code)
+	}
+	p.Batch = true
+	huge := []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f}
+	if w := postBatch(p, huge); w.Code != http.StatusBadRequest {
+		t.Errorf("huge frame: %d", w.Code)
+	}
+	if w := postBatch(p, batchBody(t, maxBatchSize+1)); w.Code != http.StatusBadRequest {
+		t.Errorf("too many keys: %d", w.Code)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	p := &PeersPool{basePath: defaultBasePath, Batch: true}
+	server := httptest.NewServer(p)
+	defer server.Close()
+	b := &batcher{url: server.URL + defaultBasePath}
+	done := make(chan error)
+	for i := 0; i < 3; i++ {
+		go func() {
+			in := &pb.GetRequest{Group: proto.String("nosuchgroup"), Key: proto.String("key")}
+			err, peerFailed := b.Get(in, new(pb.GetResponse))
+			if peerFailed {
+				t.Error("unknown group counted as a peer failure")
+			}
+			done <- err
+		}()
+	}
+	for i := 0; i < 3; i++ {
+		if err := <-done; err == nil {
+			t.Error("got a value of an unknown group")
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"image"
+	"math"
+	"net/url"
+	"strconv"
+)
+
+const (
+	// Width of the /image variant BlurHashes are computed from.
+	blurhashSourceWidth = 64
+	// The image is then scaled down to fit in a square this large.
+	blurhashSampleSize = 32
+)
+
+type blurhash struct {
+	BlurHash string
+}
+
+type BlurHashFetcher struct {
+	DumpContentResponse
+}
+
+// Generate encodes a BlurHash (https://blurha.sh) with x*y components, 4*3 by default.
+func (b BlurHashFetcher) Generate(query url.Values) (content []byte, err error) {
+	x, _ := strconv.Atoi(query.Get("x"))
+	y, _ := strconv.Atoi(query.Get("y"))
+	if x < 1 || x > 9 {
+		x = 4
+	}
+	if y < 1 || y > 9 {
+		y = 3
+	}
+	m, err := cachedImage(query.Get("url"), blurhashSourceWidth)
+	if err != nil {
+		return nil, err
+	}
+	w, h := fitIn(m.Bounds().Dx(), m.Bounds().Dy(), blurhashSampleSize)
+	m = Resize(m, m.Bounds(), w, h)
+	return json.Marshal(blurhash{encodeBlurHash(m, x, y)})
+}
+
+const base83Chars = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+func base83(buf []byte, value, length int) []byte {
+	for i := length - 1; i >= 0; i-- {
+		d := value
+		for j := 0; j < i; j++ {
+			d /= 83
+		}
+		buf = append(buf, base83Chars[d%83])
+	}
+	return buf
+}
+
+func encodeBlurHash(m image.Image, cx, cy int) string {
+	b := m.Bounds()
+	w, h := b.Dx(), b.Dy()
+	lut := linearLUT()
+	factors := make([][3]float64, cx*cy)
+	for j := 0; j < cy; j++ {
+		for i := 0; i < cx; i++ {
+			norm := 2.0
+			if i == 0 && j == 0 {
+				norm = 1
+			}
+			var f [3]float64
+			for y := 0; y < h; y++ {
+				for x := 0; x < w; x++ {
+					basis := norm * math.Cos(math.Pi*float64(i*x)/float64(w)) * math.Cos(math.Pi*float64(j*y)/float64(h))
+					r, g, bl, _ := m.At(b.Min.X+x, b.Min.Y+y).RGBA()
+					f[0] += basis * float64(lut[r])
+					f[1] += basis * float64(lut[g])
+					f[2] += basis * float64(lut[bl])
+				}
+			}
+			scale := 1 / float64(w*h)
+			factors[j*cx+i] = [3]float64{f[0] * scale, f[1] * scale, f[2] * scale}
+		}
+	}
+
+	buf := base83(nil, (cx-1)+(cy-1)*9, 1)
+	maximum := 1.0
+	if ac := factors[1:]; len(ac) > 0 {
+		var actual float64
+		for _, f := range ac {
+			actual = math.Max(actual, math.Max(math.Abs(f[0]), math.Max(math.Abs(f[1]), math.Abs(f[2]))))
+		}
+		quantised := int(math.Max(0, math.Min(82, math.Floor(actual*166-0.5))))
+		maximum = float64(quantised+1) / 166
+		buf = base83(buf, quantised, 1)
+	} else {
+		buf = base83(buf, 0, 1)
+	}
+	dc := factors[0]
+	buf = base83(buf, toSRGB8(dc[0])<<16|toSRGB8(dc[1])<<8|toSRGB8(dc[2]), 4)
+	for _, f := range factors[1:] {
+		quant := func(v float64) int {
+			return int(math.Max(0, math.Min(18, math.Floor(signPow(v/maximum, 0.5)*9+9.5))))
+		}
+		buf = base83(buf, quant(f[0])*19*19+quant(f[1])*19+quant(f[2]), 2)
+	}
+	return string(buf)
+}
+
+// toSRGB8 converts linear light to an 8-bit sRGB value.
+func toSRGB8(v float64) int {
+	v = math.Max(0, math.Min(1, v))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+func signPow(v, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(v), exp), v)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	pb "github.com/golang/groupcache/groupcachepb"
+	"github.com/golang/protobuf/proto"
+)
+
+// breakerPool returns a pool of this node and a peer served by handler,
+// and a key owned by the peer.
+func breakerPool(t *testing.T, handler http.HandlerFunc) (*PeersPool, string, string) {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	p := &PeersPool{basePath: defaultBasePath, replicas: defaultReplicas, self: "http://self", Timeout: 50 * time.Millisecond}
+	p.Set(p.self, server.URL)
+	for i := 0; ; i++ {
+		key := string(rune('a' + i))
+		if p.peers.Get(key) == server.URL {
+			return p, server.URL, key
+		}
+	}
+}
+
+// getFrom gets key from its owner, telling whether the pool sent the request.
+func getFrom(p *PeersPool, key string) (sent bool, err error) {
+	getter, ok := p.pick("group", key)
+	if !ok {
+		return false, nil
+	}
+	in := &pb.GetRequest{Group: proto.String("group"), Key: proto.String(key)}
+	return true, getter.Get(nil, in, new(pb.GetResponse))
+}
+
+func TestBreaker(t *testing.T) {
+	var down int32 = 1
+	value, _ := proto.Marshal(&pb.GetResponse{Value: []byte("value")})
+	p, peer, key := breakerPool(t, func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&down) != 0 {
+			http.Error(w, "draining", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write(value)
+	})
+
+	for i := 0; i < breakerFailures; i++ {
+		if sent, err := getFrom(p, key); !sent || err == nil {
+			t.Fatalf("get %d: sent %v, %v", i, sent, err)
+		}
+	}
+	if sent, _ := getFrom(p, key); sent {
+		t.Error("failing peer not skipped")
+	}
+	if stats := p.Stats()[peer]; !stats.Open || stats.Skipped != 1 || stats.Errors != breakerFailures {
+		t.Errorf("stats %+v after tripping", stats)
+	}
+
+	// Once the breaker times out, a request goes through, and the peer is
+	// readmitted as it succeeds.
+	atomic.StoreInt32(&down, 0)
+	p.mu.Lock()
+	p.health[peer].openUntil = time.Now()
+	p.mu.Unlock()
+	if sent, err := getFrom(p, key); !sent || err != nil {
+		t.Fatalf("probe: sent %v, %v", sent, err)
+	}
+	if sent, err := getFrom(p, key); !sent || err != nil {
+		t.Errorf("after recovery: sent %v, %v", sent, err)
+	}
+	if stats := p.Stats()[peer]; stats.Open {
+		t.Errorf("stats %+v after recovery", stats)
+	}
+}
+
+func TestBreakerSlowPeer(t *testing.T) {
+	p, peer, key := breakerPool(t, func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	})
+	// A peer still loading times out, but isn't skipped.
+	for i := 0; i < breakerFailures+1; i++ {
+		if sent, err := getFrom(p, key); !sent || err == nil {
+			t.Fatalf("get %d: sent %v, %v", i, sent, err)
+		}
+	}
+	if stats := p.Stats()[peer]; stats.Open || stats.Errors != breakerFailures+1 {
+		t.Errorf("stats %+v of a slow peer", stats)
+	}
+}
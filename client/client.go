@@ -19,6 +19,8 @@ func timeblock(ttl uint32, x []byte) uint32 {
 type Client struct {
 	// hostname:port for the GGFetch service.
 	Host string
+	// Scheme of the service, http if empty. Nodes with mutual TLS serve https.
+	Scheme string
 	// Default TTL value for requests. It will be override explicitly in the Do method.
 	TTL uint32
 	// HTTP Client to use. Will use http.DefaultClient if nil.
@@ -47,8 +49,12 @@ func (c Client) Do(method string, ttl uint32, kvs ...string) (*http.Response, er
 		tb := timeblock(ttl, []byte(q.Encode()))
 		q.Set("_t", strconv.FormatInt(int64(tb), 10))
 	}
+	scheme := c.Scheme
+	if scheme == "" {
+		scheme = "http"
+	}
 	u := url.URL{
-		Scheme:   "http",
+		Scheme:   scheme,
 		Host:     c.Host,
 		Path:     "/" + method,
 		RawQuery: q.Encode(),
@@ -77,10 +83,65 @@ func (c Client) Image(u string, width int) (content []byte, err error) {
 }
 
 func (c Client) Dimension(u string) (w, h int, err error) {
-	var dim struct {
-		Width, Height int
-	}
-	err = JSON(c.Do("dimension", c.TTL, "url", u)).Decode(&dim)
+	dim, err := c.DimensionInfo(u)
 	w, h = dim.Width, dim.Height
 	return
 }
+
+type Dimension struct {
+	Width, Height int
+	// EXIF orientation, 1 to 8, or 0 if unknown.
+	Orientation int
+	// Width and Height as displayed, after applying the orientation.
+	OrientedWidth, OrientedHeight int
+	Format                        string
+	ContentType                   string
+	// -1 if unknown.
+	ContentLength int64
+	Animated      bool
+	Frames        int
+	ColorModel    string
+	// The URL after redirects.
+	URL string
+}
+
+func (c Client) DimensionInfo(u string) (dim Dimension, err error) {
+	err = JSON(c.Do("dimension", c.TTL, "url", u)).Decode(&dim)
+	return
+}
+
+type PaletteColor struct {
+	Color  string
+	Weight float64
+}
+
+type Palette struct {
+	// Colours are in #rrggbb notation.
+	Dominant    string
+	Palette     []PaletteColor
+	Luminance   float64
+	Transparent bool
+}
+
+func (c Client) Palette(u string, colors int) (p Palette, err error) {
+	err = JSON(c.Do("palette", c.TTL, "url", u, "colors", strconv.Itoa(colors))).Decode(&p)
+	return
+}
+
+// Hashes are 64-bit perceptual hashes in hex. Compare them with Distance.
+type Hashes struct {
+	AHash, DHash, PHash string
+}
+
+func (c Client) PHash(u string) (h Hashes, err error) {
+	err = JSON(c.Do("phash", c.TTL, "url", u)).Decode(&h)
+	return
+}
+
+func (c Client) BlurHash(u string, x, y int) (string, error) {
+	var b struct {
+		BlurHash string
+	}
+	err := JSON(c.Do("blurhash", c.TTL, "url", u, "x", strconv.Itoa(x), "y", strconv.Itoa(y))).Decode(&b)
+	return b.BlurHash, err
+}
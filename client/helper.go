@@ -4,7 +4,9 @@ import (
 	"encoding/json"
 	"io"
 	"io/ioutil"
+	"math/bits"
 	"net/http"
+	"strconv"
 )
 
 func ReadAll(resp *http.Response, err error) ([]byte, error) {
@@ -39,3 +41,17 @@ func (j jsonHelper) Decode(v interface{}) error {
 	defer j.rc.Close()
 	return json.NewDecoder(j.rc).Decode(v)
 }
+
+// Distance returns the Hamming distance between two hex encoded hashes.
+// Near-duplicate images are usually within a distance of 10.
+func Distance(a, b string) (int, error) {
+	x, err := strconv.ParseUint(a, 16, 64)
+	if err != nil {
+		return 0, err
+	}
+	y, err := strconv.ParseUint(b, 16, 64)
+	if err != nil {
+		return 0, err
+	}
+	return bits.OnesCount64(x ^ y), nil
+}
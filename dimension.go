@@ -1,14 +1,34 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"image"
+	"io"
 	"net/http"
 	"net/url"
 )
 
+// Most bytes read for the dimensions, which are in the header.
+const maxDimensionBytes = 2 << 20
+
 type dimension struct {
 	Width, Height int
+	// EXIF orientation, 1 to 8, or 0 if unknown.
+	Orientation int
+	// Width and Height as displayed, after applying the orientation.
+	OrientedWidth, OrientedHeight int
+	Format                        string
+	ContentType                   string
+	// -1 if unknown.
+	ContentLength int64
+	Animated      bool
+	// 1, or 0 if animated or unknown: counting the frames would read the
+	// whole image.
+	Frames     int
+	ColorModel string
+	// The URL after redirects.
+	URL string
 }
 
 type DimensionFetcher struct {
@@ -19,14 +39,60 @@ type DimensionFetcher struct {
 
 func (d DimensionFetcher) Generate(query url.Values) (content []byte, err error) {
 	u := query.Get("url")
-	resp, err := d.Client.Get(u)
+	body, err := NewRangeReader(d.Client, u, maxDimensionBytes)
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
-	c, _, err := image.DecodeConfig(resp.Body)
-	if err != nil {
+	defer body.Close()
+	resp := body.Response
+
+	// Keep what DecodeConfig reads, the metadata is in the same header.
+	head := new(bytes.Buffer)
+	c, format, err := image.DecodeConfig(io.TeeReader(body, head))
+	switch err {
+	case nil:
+		break
+	case image.ErrFormat:
+		return nil, ContentError{u, ContentUnsupported}
+	case io.ErrUnexpectedEOF:
+		return nil, ContentError{u, ContentTruncated}
+	default:
 		return nil, err
 	}
-	return json.Marshal(dimension{c.Width, c.Height})
+
+	dim := dimension{
+		Width:         c.Width,
+		Height:        c.Height,
+		Format:        format,
+		ContentType:   resp.Header.Get("Content-Type"),
+		ContentLength: body.Size,
+		Frames:        1,
+		ColorModel:    colorModelName(c.ColorModel),
+		URL:           resp.Request.URL.String(),
+	}
+	switch format {
+	case "jpeg":
+		dim.Orientation = jpegOrientation(head.Bytes())
+	case "tiff":
+		dim.Orientation = tiffOrientation(head.Bytes())
+	case "gif":
+		frames, err := gifFrames(io.MultiReader(head, body), 2)
+		if _, ok := err.(ContentError); ok {
+			// The first frame is too large to tell.
+			dim.Frames = 0
+			break
+		}
+		if err != nil {
+			return nil, ContentError{u, ContentTruncated}
+		}
+		if dim.Animated = frames > 1; dim.Animated {
+			dim.Frames = 0
+		}
+	}
+	dim.OrientedWidth, dim.OrientedHeight = c.Width, c.Height
+	if dim.Orientation >= 5 {
+		// Orientations 5 to 8 are rotated by 90 degrees.
+		dim.OrientedWidth, dim.OrientedHeight = c.Height, c.Width
+	}
+	return json.Marshal(dim)
 }
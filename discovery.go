@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+const defaultDNSInterval = 10 * time.Second
+
+// peerURLs turns host:port nodes into the base URLs of peers, adding self if missing.
+func peerURLs(scheme, self string, nodes []string) []string {
+	ret := []string{peerURL(scheme, self)}
+	for _, node := range nodes {
+		if node != self {
+			ret = append(ret, peerURL(scheme, node))
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// DNSDiscovery finds the peers by resolving a name periodically, such as a
+// headless service. Names of the form _service._proto.name are resolved as
+// SRV records, giving the port of each peer, and their targets are resolved
+// to addresses. Other names are resolved as A or AAAA records, and the peers
+// are assumed to listen on Port.
+type DNSDiscovery struct {
+	// This node, as host:port. It must be the address the others resolve.
+	Self string
+	Name string
+	Port int
+	// Scheme of the URLs of peers, http if empty.
+	Scheme string
+	// Defaults to defaultDNSInterval.
+	Interval time.Duration
+
+	// The resolver and the addresses of this host, replaced in tests.
+	lookupSRV  func(name string) ([]*net.SRV, error)
+	lookupHost func(host string) ([]string, error)
+	localAddrs func() ([]net.Addr, error)
+}
+
+func (d *DNSDiscovery) resolve() (nodes []string, err error) {
+	lookupHost := d.lookupHost
+	if lookupHost == nil {
+		lookupHost = net.LookupHost
+	}
+	if strings.HasPrefix(d.Name, "_") {
+		lookupSRV := d.lookupSRV
+		if lookupSRV == nil {
+			lookupSRV = func(name string) ([]*net.SRV, error) {
+				_, srvs, err := net.LookupSRV("", "", name)
+				return srvs, err
+			}
+		}
+		srvs, err := lookupSRV(d.Name)
+		if err != nil {
+			return nil, err
+		}
+		for _, srv := range srvs {
+			// Nodes are known by address, as this one is by Self.
+			addrs, err := lookupHost(strings.TrimSuffix(srv.Target, "."))
+			if err != nil {
+				return nil, err
+			}
+			nodes = append(nodes, net.JoinHostPort(addrs[0], fmt.Sprint(srv.Port)))
+		}
+		return d.others(nodes), nil
+	}
+	addrs, err := lookupHost(d.Name)
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		nodes = append(nodes, net.JoinHostPort(addr, fmt.Sprint(d.Port)))
+	}
+	return d.others(nodes), nil
+}
+
+// others leaves this node out of nodes, where it may have another address
+// than Self, such as one of its interfaces when binding all of them.
+func (d *DNSDiscovery) others(nodes []string) []string {
+	localAddrs := d.localAddrs
+	if localAddrs == nil {
+		localAddrs = net.InterfaceAddrs
+	}
+	local := make(map[string]bool)
+	if addrs, err := localAddrs(); err == nil {
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok {
+				local[ipnet.IP.String()] = true
+			}
+		}
+	}
+	_, selfPort, _ := net.SplitHostPort(d.Self)
+	var ret []string
+	for _, node := range nodes {
+		host, port, _ := net.SplitHostPort(node)
+		if node == d.Self || port == selfPort && local[host] {
+			continue
+		}
+		ret = append(ret, node)
+	}
+	return ret
+}
+
+// Run resolves the name forever, passing the peers to setpeers whenever they
+// change. The last peers are kept while the name fails to resolve.
+func (d *DNSDiscovery) Run(setpeers func(peers ...string)) {
+	interval := d.Interval
+	if interval <= 0 {
+		interval = defaultDNSInterval
+	}
+	var last []string
+	for {
+		nodes, err := d.resolve()
+		if err != nil {
+			log.Println("!!! ERROR Cannot resolve peers:", d.Name, err)
+		} else if live := peerURLs(d.Scheme, d.Self, nodes); !equalStrings(live, last) {
+			log.Println("Peers resolved:", live)
+			setpeers(live...)
+			last = live
+		}
+		time.Sleep(interval)
+	}
+}
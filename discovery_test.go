@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestDNSDiscoverySRV(t *testing.T) {
+	hosts := map[string][]string{
+		"node-0.ggfetch.svc": {"10.0.0.1"},
+		"node-1.ggfetch.svc": {"10.0.0.2"},
+	}
+	d := &DNSDiscovery{
+		Name: "_http._tcp.ggfetch.svc",
+		lookupSRV: func(name string) ([]*net.SRV, error) {
+			return []*net.SRV{
+				{Target: "node-0.ggfetch.svc.", Port: 9001},
+				{Target: "node-1.ggfetch.svc.", Port: 9001},
+			}, nil
+		},
+		lookupHost: func(host string) ([]string, error) {
+			return hosts[host], nil
+		},
+		localAddrs: func() ([]net.Addr, error) {
+			return []net.Addr{&net.IPNet{IP: net.ParseIP("10.0.0.1"), Mask: net.CIDRMask(24, 32)}}, nil
+		},
+	}
+	for _, self := range []string{
+		"10.0.0.1:9001",
+		// Binding all interfaces, this node is known by the one resolved.
+		"0.0.0.0:9001",
+	} {
+		d.Self = self
+		nodes, err := d.resolve()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []string{"10.0.0.2:9001"}; !reflect.DeepEqual(nodes, want) {
+			t.Errorf("self %s: got peers %v, want %v", self, nodes, want)
+		}
+	}
+
+	// Another node on this host is a peer.
+	d.Self = "10.0.0.1:9002"
+	nodes, err := d.resolve()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"10.0.0.1:9001", "10.0.0.2:9001"}; !reflect.DeepEqual(nodes, want) {
+		t.Errorf("got peers %v, want %v", nodes, want)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+)
+
+// Drainer takes this node out of the cluster before it stops: peers stop
+// routing keys to it as soon as they hear it's leaving, and it stops
+// serving them, while the fetches in flight complete.
+type Drainer struct {
+	// This node, as host:port.
+	Self  string
+	Peers *PeersPool
+	// Scheme of the URLs of peers, http if empty.
+	Scheme string
+	// Client to tell the peers, which should have a short timeout.
+	Client *http.Client
+	// Leave applies a node leaving to the membership, if set.
+	Leave func(node string)
+
+	once sync.Once
+}
+
+// Drain refuses new requests from peers, tells them this node is leaving,
+// and waits for the requests in flight.
+func (d *Drainer) Drain() {
+	d.once.Do(func() {
+		log.Println("Draining, leaving the cluster")
+		d.Peers.Drain()
+		if d.Leave != nil {
+			d.Leave(d.Self)
+		}
+		var wg sync.WaitGroup
+		for _, peer := range d.Peers.Peers() {
+			if peer == peerURL(d.Scheme, d.Self) {
+				continue
+			}
+			wg.Add(1)
+			go func(peer string) {
+				defer wg.Done()
+				resp, err := d.Client.Get(peer + "/leave?peer=" + url.QueryEscape(d.Self))
+				if err != nil {
+					log.Println("!!! ERROR Cannot tell peer about leaving:", peer, err)
+					return
+				}
+				resp.Body.Close()
+			}(peer)
+		}
+		wg.Wait()
+	})
+	d.Peers.Wait()
+}
+
+// ServeHTTP drains the node, and returns once drained.
+func (d *Drainer) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	d.Drain()
+	response.Write([]byte("drained\n"))
+}
+
+// ServeLeave removes the peer leaving at once.
+func (d *Drainer) ServeLeave(response http.ResponseWriter, request *http.Request) {
+	peer := request.FormValue("peer")
+	if peer == "" || peer == d.Self {
+		http.Error(response, "bad peer", http.StatusBadRequest)
+		return
+	}
+	log.Println("Peer left:", peer)
+	d.Peers.Remove(peerURL(d.Scheme, peer))
+	if d.Leave != nil {
+		d.Leave(peer)
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	heartbeatInterval = 3 * time.Second
+	// How long a node that failed to answer a heartbeat isn't considered for master.
+	failedTimeout = 30 * time.Second
+)
+
+// Election picks the master every node sends heartbeats to, and gets the
+// live peers and the config from. The master is the first node to answer
+// among the seeds in order, or this node if there are none, and then the
+// peers last heard of by address. As every node knows the same peers, they
+// all move on to the same node when the master dies, and back when it returns.
+//
+// Election also serves /ping, telling nodes which master it follows, so
+// that a node seeded with any member of the cluster finds the master.
+type Election struct {
+	// This node, as host:port.
+	Self string
+	// Nodes to try first, as host:port.
+	Seeds []string
+	// Client for heartbeats, which should have a short timeout.
+	Client *http.Client
+	// Peers records the heartbeats received.
+	Peers *PeersManager
+	// Scheme of the URLs of peers, http if empty.
+	Scheme string
+	// Weight of this node in the consistent hash, and its current load if
+	// set, advertised in the heartbeats.
+	Weight int
+	Load   func() int
+
+	mu     sync.Mutex
+	master string
+	// The master suggested by the last node answering a heartbeat.
+	hint   string
+	known  []string
+	failed map[string]time.Time
+	// This node left, its heartbeats no longer register it.
+	left bool
+}
+
+// Master returns the current master, as host:port.
+func (e *Election) Master() string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.master == "" {
+		// Not elected yet.
+		return e.Self
+	}
+	return e.master
+}
+
+// candidates returns the nodes that may be master, best first.
+func (e *Election) candidates() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	first := e.Seeds
+	if len(first) == 0 {
+		first = []string{e.Self}
+	}
+	rest := append([]string{e.Self}, e.known...)
+	sort.Strings(rest)
+
+	var ret []string
+	seen := make(map[string]bool)
+	for _, list := range [][]string{{e.hint}, first, rest} {
+		for _, n := range list {
+			if n == "" || seen[n] {
+				continue
+			}
+			seen[n] = true
+			if e.hasFailed(n) {
+				continue
+			}
+			ret = append(ret, n)
+		}
+	}
+	return ret
+}
+
+// hasFailed tells whether node failed to answer a heartbeat lately. It's
+// called with the lock held.
+func (e *Election) hasFailed(node string) bool {
+	t, ok := e.failed[node]
+	return ok && time.Since(t) < failedTimeout
+}
+
+func (e *Election) fail(node string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.failed == nil {
+		e.failed = make(map[string]time.Time)
+	}
+	e.failed[node] = time.Now()
+}
+
+func (e *Election) elect(node, hint string, livePeers map[string]PeerInfo) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if node != e.master {
+		log.Println("Master is now:", node)
+		e.master = node
+	}
+	e.hint = ""
+	if hint != node {
+		e.hint = hint
+	}
+	e.known = e.known[:0]
+	for p := range livePeers {
+		e.known = append(e.known, stripPeerURL(p))
+	}
+}
+
+// Leave applies node leaving the cluster.
+func (e *Election) Leave(node string) {
+	if node != e.Self {
+		e.Peers.Remove(peerURL(e.Scheme, node))
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.left = true
+}
+
+// ping sends a heartbeat to node and returns the live peers it knows of,
+// and the master it follows. Version 2 of /ping returns the peers with
+// their weights and loads, older nodes return a list of peers, which get a
+// weight of 1.
+func (e *Election) ping(node string) (livePeers map[string]PeerInfo, master string, err error) {
+	u := peerURL(e.Scheme, node) + "/ping?v=2"
+	e.mu.Lock()
+	left := e.left
+	e.mu.Unlock()
+	if !left {
+		load := 0
+		if e.Load != nil {
+			load = e.Load()
+		}
+		u += fmt.Sprintf("&peer=%s&weight=%d&load=%d", e.Self, e.Weight, load)
+	}
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return
+	}
+	resp, err := e.Client.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		err = StatusCodeError{req.URL.String(), resp.StatusCode}
+		return
+	}
+	var body json.RawMessage
+	if err = json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return
+	}
+	master = resp.Header.Get("X-Master")
+	if len(body) > 0 && body[0] == '[' {
+		var peers []string
+		if err = json.Unmarshal(body, &peers); err != nil {
+			return
+		}
+		livePeers = make(map[string]PeerInfo, len(peers))
+		for _, peer := range peers {
+			livePeers[peer] = PeerInfo{Weight: 1}
+		}
+		return
+	}
+	err = json.Unmarshal(body, &livePeers)
+	return
+}
+
+func (e *Election) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	response.Header().Set("X-Master", e.Master())
+	e.Peers.ServeHTTP(response, request)
+}
+
+// Heartbeat sends heartbeats to the master forever, passing the live peers
+// to setpeers.
+func (e *Election) Heartbeat(setpeers func(peers map[string]PeerInfo)) {
+	for {
+		e.beat(setpeers)
+		time.Sleep(heartbeatInterval)
+	}
+}
+
+// beat sends a heartbeat to the first candidate answering.
+func (e *Election) beat(setpeers func(peers map[string]PeerInfo)) {
+	for _, node := range e.candidates() {
+		livePeers, hint, err := e.ping(node)
+		if err != nil {
+			log.Println("!!! ERROR Cannot connect to master candidate:", node, err)
+			e.fail(node)
+			continue
+		}
+		e.mu.Lock()
+		follow := hint != "" && hint != node && !e.hasFailed(hint)
+		e.mu.Unlock()
+		if follow {
+			// The node follows another master, which alone knows all the
+			// peers, unless it's gone.
+			masterPeers, masterHint, err := e.ping(hint)
+			if err != nil {
+				log.Println("!!! ERROR Cannot connect to master candidate:", hint, err)
+				e.fail(hint)
+				continue
+			}
+			node, livePeers, hint = hint, masterPeers, masterHint
+		}
+		e.elect(node, hint, livePeers)
+		setpeers(livePeers)
+		return
+	}
+}
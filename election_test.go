@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type testNode struct {
+	*Election
+	server *httptest.Server
+	down   int32
+	peers  map[string]PeerInfo
+}
+
+func (n *testNode) addr() string {
+	return n.server.Listener.Addr().String()
+}
+
+func (n *testNode) beat() {
+	n.Election.beat(func(peers map[string]PeerInfo) { n.peers = peers })
+}
+
+// livePeers returns the host:port of the peers last set.
+func (n *testNode) livePeers() []string {
+	var ret []string
+	for peer := range n.peers {
+		ret = append(ret, stripPeerURL(peer))
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// newTestNodes starts n nodes, seeded with the first seeds of them.
+func newTestNodes(t *testing.T, n, seeds int) []*testNode {
+	nodes := make([]*testNode, n)
+	for i := range nodes {
+		node := &testNode{}
+		node.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if atomic.LoadInt32(&node.down) != 0 {
+				http.Error(w, "down", http.StatusServiceUnavailable)
+				return
+			}
+			node.Election.ServeHTTP(w, r)
+		}))
+		t.Cleanup(node.server.Close)
+		nodes[i] = node
+	}
+	for _, node := range nodes {
+		var seedAddrs []string
+		for _, seed := range nodes[:seeds] {
+			seedAddrs = append(seedAddrs, seed.addr())
+		}
+		node.Election = &Election{
+			Self:   node.addr(),
+			Seeds:  seedAddrs,
+			Client: &http.Client{Timeout: time.Second},
+			Peers:  new(PeersManager),
+			Weight: 1,
+		}
+	}
+	return nodes
+}
+
+func addrs(nodes []*testNode) []string {
+	var ret []string
+	for _, node := range nodes {
+		ret = append(ret, node.addr())
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func beat(nodes []*testNode, rounds int) {
+	for i := 0; i < rounds; i++ {
+		for _, node := range nodes {
+			node.beat()
+		}
+	}
+}
+
+func checkElected(t *testing.T, nodes []*testNode, master *testNode, peers []*testNode) {
+	t.Helper()
+	for _, node := range nodes {
+		if got := node.Master(); got != master.addr() {
+			t.Errorf("%s follows %s, want %s", node.addr(), got, master.addr())
+		}
+		if got, want := node.livePeers(), addrs(peers); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s has peers %v, want %v", node.addr(), got, want)
+		}
+	}
+}
+
+func TestElection(t *testing.T) {
+	nodes := newTestNodes(t, 3, 2)
+	beat(nodes, 2)
+	checkElected(t, nodes, nodes[0], nodes)
+
+	// The next seed takes over when the master dies.
+	atomic.StoreInt32(&nodes[0].down, 1)
+	beat(nodes[1:], 2)
+	checkElected(t, nodes[1:], nodes[1], nodes[1:])
+}
+
+func TestElectionFollowsHint(t *testing.T) {
+	nodes := newTestNodes(t, 4, 1)
+	beat(nodes[:3], 2)
+
+	// A node seeded with another member finds the master, and gets all the
+	// peers from it rather than the partial ones of the member.
+	late := nodes[3]
+	late.Seeds = []string{nodes[2].addr()}
+	late.beat()
+	checkElected(t, nodes[3:], nodes[0], nodes)
+}
+
+func TestPingCompatible(t *testing.T) {
+	nodes := newTestNodes(t, 2, 1)
+	nodes[0].Weight = 3
+	beat(nodes, 2)
+
+	// Older nodes ping without a version, and get the list of peers.
+	resp, err := http.Get("http://" + nodes[0].addr() + "/ping?peer=old:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var list []string
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		t.Fatalf("old nodes can't read /ping: %v", err)
+	}
+	want := []string{"http://" + nodes[0].addr(), "http://" + nodes[1].addr(), "http://old:80"}
+	sort.Strings(want)
+	if !reflect.DeepEqual(list, want) {
+		t.Errorf("got peers %v, want %v", list, want)
+	}
+
+	// An older master answers a list, whose peers get a weight of 1.
+	old := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(list)
+	}))
+	defer old.Close()
+	peers, _, err := nodes[1].ping(old.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != len(list) || peers["http://"+nodes[0].addr()].Weight != 1 {
+		t.Errorf("got peers %v from an older master", peers)
+	}
+	if nodes[1].peers["http://"+nodes[0].addr()].Weight != 3 {
+		t.Errorf("weight of the master not advertised: %v", nodes[1].peers)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// StatusCoder is implemented by errors that map to an HTTP status code.
+type StatusCoder interface {
+	StatusCode() int
+}
+
+type ContentErrorReason int
+
+const (
+	// The content exceeds MaxItemSize.
+	ContentTooLarge ContentErrorReason = iota
+	// The content type or image format is not supported.
+	ContentUnsupported
+	// The content ended prematurely.
+	ContentTruncated
+)
+
+var contentErrorReasons = []string{
+	ContentTooLarge:    "Content too large",
+	ContentUnsupported: "Unsupported content",
+	ContentTruncated:   "Truncated content",
+}
+
+// ContentError is returned when the origin responded, but with content that can't be served.
+type ContentError struct {
+	URL    string
+	Reason ContentErrorReason
+}
+
+func (c ContentError) Error() string {
+	return fmt.Sprintf("%s for URL: %s", contentErrorReasons[c.Reason], c.URL)
+}
+
+func (c ContentError) StatusCode() int {
+	switch c.Reason {
+	case ContentTooLarge:
+		return http.StatusRequestEntityTooLarge
+	case ContentUnsupported:
+		return http.StatusUnsupportedMediaType
+	}
+	return http.StatusBadGateway
+}
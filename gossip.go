@@ -0,0 +1,383 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	gossipInterval = time.Second
+	// Timeout of a direct probe, well under gossipInterval.
+	probeTimeout = 300 * time.Millisecond
+	// Number of members asked to probe a member that didn't answer.
+	indirectProbes = 3
+	// How long a suspected member has to refute it before it's declared dead.
+	suspectTimeout = 5 * time.Second
+	// How long dead members are remembered, so that older news doesn't bring them back.
+	deadTimeout = time.Minute
+)
+
+type memberState int
+
+const (
+	memberAlive memberState = iota
+	memberSuspect
+	memberDead
+)
+
+func (s memberState) String() string {
+	switch s {
+	case memberAlive:
+		return "alive"
+	case memberSuspect:
+		return "suspect"
+	}
+	return "dead"
+}
+
+// Member is the state of a node, as gossiped.
+type Member struct {
+	// The node, as host:port.
+	Addr string
+	// Only the node itself increments it, to refute being suspected. It
+	// starts from the time the node started, so that a restarted node
+	// overrides what was known of it.
+	Incarnation uint64
+	State       memberState
+	// Weight in the consistent hash.
+	Weight int
+	// Requests served to peers, as of LoadTime, in nanoseconds of the clock
+	// of the node, which only moves forward for a given node.
+	Load     int
+	LoadTime int64
+}
+
+type member struct {
+	Member
+	// When State last changed.
+	since time.Time
+}
+
+// Gossip maintains the members of the cluster without a master, in the
+// manner of SWIM. Every interval a member is probed, and both ends exchange
+// their view of the membership. When it doesn't answer, a few other members
+// are asked to probe it, and it's suspected only if none of them can reach
+// it either. A suspected member which doesn't refute it in time is declared
+// dead. Nodes join through any of the seeds.
+type Gossip struct {
+	// This node, as host:port.
+	Self string
+	// Nodes to join through, as host:port.
+	Seeds []string
+	// Client for direct probes, with a timeout of probeTimeout.
+	Client *http.Client
+	// Scheme of the URLs of peers, http if empty.
+	Scheme string
+	// Weight of this node in the consistent hash.
+	Weight int
+	// Load optionally returns the current load of this node.
+	Load func() int
+
+	mu          sync.Mutex
+	incarnation uint64
+	// This node left, and is gossiped as dead.
+	left    bool
+	members map[string]*member
+	// Members left to probe this round.
+	queue []string
+}
+
+// snapshot returns the membership as known by this node, including itself.
+func (g *Gossip) snapshot() []Member {
+	load := 0
+	if g.Load != nil {
+		load = g.Load()
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	self := Member{g.Self, g.incarnation, memberAlive, g.Weight, load, time.Now().UnixNano()}
+	if g.left {
+		self.State = memberDead
+	}
+	ret := []Member{self}
+	for _, m := range g.members {
+		ret = append(ret, m.Member)
+	}
+	return ret
+}
+
+// merge applies the membership known by another node. Newer incarnations
+// override older ones, and within an incarnation dead overrides suspect,
+// which overrides alive.
+func (g *Gossip) merge(ms []Member) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.members == nil {
+		g.members = make(map[string]*member)
+	}
+	for _, m := range ms {
+		if m.Addr == g.Self {
+			if !g.left && m.State != memberAlive && m.Incarnation >= g.incarnation {
+				g.incarnation = m.Incarnation + 1
+			}
+			continue
+		}
+		l, ok := g.members[m.Addr]
+		if !ok {
+			if m.State != memberDead {
+				log.Println("Member joined:", m.Addr)
+				g.members[m.Addr] = &member{m, time.Now()}
+			}
+			continue
+		}
+		if m.Incarnation > l.Incarnation || m.Incarnation == l.Incarnation && m.State > l.State {
+			if m.State != l.State {
+				log.Printf("Member %s is now %s", m.Addr, m.State)
+				l.since = time.Now()
+			}
+			l.Member = m
+		}
+		if m.LoadTime > l.LoadTime {
+			l.Load, l.LoadTime = m.Load, m.LoadTime
+		}
+	}
+}
+
+// suspect marks addr as suspect, unless it refuted it in the meantime.
+func (g *Gossip) suspect(addr string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if m, ok := g.members[addr]; ok && m.State == memberAlive {
+		log.Println("Member is now suspect:", addr)
+		m.State = memberSuspect
+		m.since = time.Now()
+	}
+}
+
+// Leave declares node dead at once, as it's leaving the cluster.
+func (g *Gossip) Leave(node string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if node == g.Self {
+		g.left = true
+		return
+	}
+	if m, ok := g.members[node]; ok && m.State != memberDead {
+		log.Println("Member left:", node)
+		m.State = memberDead
+		m.since = time.Now()
+	}
+}
+
+// expire declares dead the suspects that didn't refute in time, and forgets
+// the members dead for long enough.
+func (g *Gossip) expire() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for addr, m := range g.members {
+		switch {
+		case m.State == memberSuspect && time.Since(m.since) > suspectTimeout:
+			log.Println("Member is now dead:", addr)
+			m.State = memberDead
+			m.since = time.Now()
+		case m.State == memberDead && time.Since(m.since) > deadTimeout:
+			delete(g.members, addr)
+		}
+	}
+}
+
+// others returns the members not known to be dead, except exclude.
+func (g *Gossip) others(exclude string) (ret []string) {
+	for addr, m := range g.members {
+		if m.State != memberDead && addr != exclude {
+			ret = append(ret, addr)
+		}
+	}
+	return
+}
+
+// next returns the member to probe, going through all of them in a random
+// order each round. It returns "" if there is none.
+func (g *Gossip) next() string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for {
+		if len(g.queue) == 0 {
+			g.queue = g.others("")
+			if len(g.queue) == 0 {
+				return ""
+			}
+			for i := range g.queue {
+				j := rand.Intn(i + 1)
+				g.queue[i], g.queue[j] = g.queue[j], g.queue[i]
+			}
+		}
+		addr := g.queue[0]
+		g.queue = g.queue[1:]
+		if m, ok := g.members[addr]; ok && m.State != memberDead {
+			return addr
+		}
+	}
+}
+
+// helpers returns up to n random members to probe target indirectly.
+func (g *Gossip) helpers(n int, target string) []string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	others := g.others(target)
+	for i := range others {
+		j := rand.Intn(i + 1)
+		others[i], others[j] = others[j], others[i]
+	}
+	if len(others) > n {
+		others = others[:n]
+	}
+	return others
+}
+
+// Live returns the base URLs of this node and the members not known to be
+// dead, with their weights and loads. The load of this node is left to the
+// caller.
+func (g *Gossip) Live() map[string]PeerInfo {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	ret := map[string]PeerInfo{peerURL(g.Scheme, g.Self): {Weight: g.Weight}}
+	for _, addr := range g.others("") {
+		m := g.members[addr]
+		ret[peerURL(g.Scheme, addr)] = PeerInfo{m.Weight, m.Load}
+	}
+	return ret
+}
+
+// probe exchanges the membership with node. If target is not empty, node is
+// asked to probe target instead, and only answers if it could.
+func (g *Gossip) probe(client *http.Client, node, target string) ([]Member, error) {
+	u := peerURL(g.Scheme, node) + "/gossip"
+	if target != "" {
+		u += "?target=" + url.QueryEscape(target)
+	}
+	body, err := json.Marshal(g.snapshot())
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Post(u, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, StatusCodeError{u, resp.StatusCode}
+	}
+	var ms []Member
+	err = json.NewDecoder(resp.Body).Decode(&ms)
+	return ms, err
+}
+
+// tick runs one protocol period.
+func (g *Gossip) tick(indirect *http.Client) {
+	g.expire()
+	target := g.next()
+	if target == "" {
+		// Alone, (re)join through the seeds.
+		for _, seed := range g.Seeds {
+			if seed == g.Self {
+				continue
+			}
+			ms, err := g.probe(g.Client, seed, "")
+			if err != nil {
+				log.Println("!!! ERROR Cannot join through seed:", seed, err)
+				continue
+			}
+			g.merge(ms)
+			return
+		}
+		return
+	}
+	ms, err := g.probe(g.Client, target, "")
+	if err == nil {
+		g.merge(ms)
+		return
+	}
+	helpers := g.helpers(indirectProbes, target)
+	results := make(chan []Member, len(helpers))
+	for _, helper := range helpers {
+		go func(helper string) {
+			ms, err := g.probe(indirect, helper, target)
+			if err != nil {
+				ms = nil
+			}
+			results <- ms
+		}(helper)
+	}
+	for range helpers {
+		if ms := <-results; ms != nil {
+			g.merge(ms)
+			return
+		}
+	}
+	g.suspect(target)
+}
+
+func (g *Gossip) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	var ms []Member
+	if err := json.NewDecoder(request.Body).Decode(&ms); err != nil {
+		http.Error(response, err.Error(), http.StatusBadRequest)
+		return
+	}
+	g.merge(ms)
+	if target := request.URL.Query().Get("target"); target != "" {
+		// Probe on behalf of a member that couldn't reach target.
+		tms, err := g.probe(g.Client, target, "")
+		if err != nil {
+			http.Error(response, err.Error(), http.StatusBadGateway)
+			return
+		}
+		g.merge(tms)
+	}
+	response.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(response).Encode(g.snapshot())
+}
+
+// Run gossips forever, passing the live members to setpeers every interval.
+func (g *Gossip) Run(setpeers func(peers map[string]PeerInfo)) {
+	g.mu.Lock()
+	g.incarnation = uint64(time.Now().Unix())
+	g.mu.Unlock()
+	// Indirect probes wait for the helper's own direct probe.
+	indirect := &http.Client{Transport: g.Client.Transport, Timeout: 2 * g.Client.Timeout}
+	var last []string
+	for range time.Tick(gossipInterval) {
+		g.tick(indirect)
+		live := g.Live()
+		var members []string
+		for peer, info := range live {
+			members = append(members, fmt.Sprintf("%s*%d", peer, info.Weight))
+		}
+		sort.Strings(members)
+		if !equalStrings(members, last) {
+			log.Println("Live members:", members)
+			last = members
+		}
+		setpeers(live)
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
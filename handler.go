@@ -13,6 +13,13 @@ type Fetcher interface {
 	WriteResponse(http.ResponseWriter, []byte) error
 }
 
+// Versioned is implemented by fetchers whose content depends on more than
+// the query, such as files reloaded with the config. The version is added
+// to the cache key as _v, so that a reload doesn't serve stale content.
+type Versioned interface {
+	Version(query url.Values) string
+}
+
 // DumpContentResponse is a Fetcher mixin that will write the cached content directly to the response.
 type DumpContentResponse struct{}
 
@@ -38,6 +45,8 @@ func (g fetcherGetter) Get(_ groupcache.Context, key string, dest groupcache.Sin
 type entry struct {
 	Group *groupcache.Group
 	Fetcher
+	// Internal groups are used by other fetchers, but not served.
+	Internal bool
 }
 
 type GGFetchHandler struct {
@@ -54,20 +63,38 @@ func (g *GGFetchHandler) Register(name string, fetcher Fetcher, size int64) {
 	}
 }
 
+// RegisterInternal registers a group for use by other fetchers only.
+func (g *GGFetchHandler) RegisterInternal(name string, fetcher Fetcher, size int64) {
+	g.Register(name, fetcher, size)
+	e := g.methods[name]
+	e.Internal = true
+	g.methods[name] = e
+}
+
 func (g *GGFetchHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	method := r.URL.Path[1:]
 	key := r.URL.RawQuery
 	log.Println("METHOD", method, "KEY", key)
 	hi, ok := g.methods[method]
-	if !ok {
+	if !ok || hi.Internal {
 		http.NotFound(w, r)
 		return
 	}
+	if v, ok := hi.Fetcher.(Versioned); ok {
+		if version := v.Version(r.URL.Query()); version != "" {
+			// First, so that it's the one read, whatever the query has.
+			key = "_v=" + url.QueryEscape(version) + "&" + key
+		}
+	}
 
 	var buf []byte
 	if err := hi.Group.Get(nil, key, groupcache.AllocatingByteSliceSink(&buf)); err != nil {
 		log.Println("ERROR", err, "METHOD", method, "KEY", key)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		code := http.StatusInternalServerError
+		if e, ok := err.(StatusCoder); ok {
+			code = e.StatusCode()
+		}
+		http.Error(w, err.Error(), code)
 		return
 	}
 	if err := hi.Fetcher.WriteResponse(w, buf); err != nil {
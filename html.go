@@ -43,6 +43,7 @@ func (h HTMLFetcher) Generate(query neturl.Values) (content []byte, err error) {
 	header, _ := buffered.Peek(512)
 	contentType := http.DetectContentType(header)
 	if !strings.HasPrefix(contentType, "text/") {
+		err = ContentError{url, ContentUnsupported}
 		return
 	}
 
@@ -85,6 +86,15 @@ func (r StatusCodeError) Error() string {
 	return fmt.Sprintf("Response code %d for URL: %s", r.Code, r.URL)
 }
 
+// StatusCode passes missing content through, other origin failures are a bad gateway.
+func (r StatusCodeError) StatusCode() int {
+	switch r.Code {
+	case http.StatusNotFound, http.StatusGone:
+		return r.Code
+	}
+	return http.StatusBadGateway
+}
+
 type fetchResponse struct {
 	URL     string
 	Content []byte
@@ -2,64 +2,351 @@ package main
 
 import (
 	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
 	"image"
 	_ "image/gif"
 	"image/jpeg"
 	"image/png"
 	"io"
+	"math"
 	"net/http"
 	neturl "net/url"
 	"strconv"
+
+	"github.com/golang/groupcache"
+	_ "golang.org/x/image/bmp"
+	_ "golang.org/x/image/tiff"
+	_ "golang.org/x/image/webp"
 )
 
 var defaultJpegOption = &jpeg.Options{Quality: 24}
 
+// maxDPR is the highest device pixel ratio accepted by dpr=.
+const maxDPR = 3
+
+const (
+	// Bounds the size of the images served when the config sets no
+	// maximum, as upscale= could ask for any size otherwise.
+	defaultMaxSize = 4096
+	// Larger widths and heights requested are scaled down to this first,
+	// so that the arithmetic on them can't overflow.
+	maxRequestSize = 1 << 16
+)
+
+// ImagePreset is a named set of defaults for image queries, selected with preset=.
+type ImagePreset struct {
+	Width   int    `yaml:"width"`
+	Height  int    `yaml:"height"`
+	Gravity string `yaml:"gravity"`
+	Filter  string `yaml:"filter"`
+	Overlay string `yaml:"overlay"`
+	// Image file served when neither the origin nor the fallback can be.
+	Placeholder string `yaml:"placeholder"`
+	// Serve a base64 data: URI instead of the image itself.
+	DataURI bool `yaml:"data_uri"`
+
+	placeholder []byte
+}
+
+// defaultPresets are available unless overridden in the config.
+var defaultPresets = map[string]ImagePreset{
+	// Low quality image placeholder, to be inlined while the image loads.
+	"lqip": {Width: 16, DataURI: true},
+}
+
+// ImageFetcher derives image variants from the sources cached by OriginalFetcher.
 type ImageFetcher struct {
-	MaxItemSize int64
-	Client      *http.Client
+	// Maximum size of the images served, 0 for no limit.
+	MaxWidth, MaxHeight int
 
-	DumpContentResponse
+	Limits   DecodeLimits
+	Presets  map[string]ImagePreset
+	Overlays *Overlays
+	// Served when an image can't be, unless the preset has its own placeholder.
+	Placeholder []byte
 }
 
-func (i ImageFetcher) Generate(q neturl.Values) (content []byte, err error) {
-	url := q.Get("url")
-	width, _ := strconv.Atoi(q.Get("width"))
+type imageResponse struct {
+	ContentType string
+	// How the content was obtained if not from the requested URL: "url" for
+	// the fallback= URL, "placeholder" for a placeholder image.
+	Fallback string
+	// The cropped rectangle of the source image, as "x,y,width,height".
+	Crop string
+	// Size of the image served.
+	Width, Height int
+	Content       []byte
+}
+
+// preset returns the preset of the query, from the config or the defaults.
+func (i ImageFetcher) preset(q neturl.Values) ImagePreset {
+	preset, ok := i.Presets[q.Get("preset")]
+	if !ok {
+		preset = defaultPresets[q.Get("preset")]
+	}
+	return preset
+}
 
-	resp, err := i.Client.Get(url)
+// Version returns the version of the overlay of the query, if any, so that
+// images are generated again when it's reloaded.
+func (i ImageFetcher) Version(q neturl.Values) string {
+	name := q.Get("overlay")
+	if name == "" {
+		name = i.preset(q).Overlay
+	}
+	if o := i.Overlays.Get(name); o != nil {
+		return o.version
+	}
+	return ""
+}
+
+func (i ImageFetcher) Generate(q neturl.Values) ([]byte, error) {
+	preset := i.preset(q)
+	if q.Get("width") == "" && preset.Width > 0 {
+		q.Set("width", strconv.Itoa(preset.Width))
+	}
+	if q.Get("height") == "" && preset.Height > 0 {
+		q.Set("height", strconv.Itoa(preset.Height))
+	}
+	if q.Get("gravity") == "" && preset.Gravity != "" {
+		q.Set("gravity", preset.Gravity)
+	}
+	if q.Get("filter") == "" && preset.Filter != "" {
+		q.Set("filter", preset.Filter)
+	}
+	if q.Get("overlay") == "" && preset.Overlay != "" {
+		q.Set("overlay", preset.Overlay)
+	}
+
+	// Only fall back when the origin responded but can't be served, as
+	// results are cached for good, unlike transient errors.
+	ir, err := i.generate(q)
+	if unservable(err) && q.Get("fallback") != "" {
+		q.Set("url", q.Get("fallback"))
+		if ir, err = i.generate(q); err == nil {
+			ir.Fallback = "url"
+		}
+	}
+	if unservable(err) {
+		placeholder := preset.placeholder
+		if placeholder == nil {
+			placeholder = i.Placeholder
+		}
+		if placeholder != nil {
+			ir, err = &imageResponse{ContentType: http.DetectContentType(placeholder), Fallback: "placeholder", Content: placeholder}, nil
+		}
+	}
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
-	if i.MaxItemSize > 0 {
-		if s, _ := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64); s > i.MaxItemSize {
-			return nil, nil
-		}
+	if preset.DataURI {
+		ir.Content = []byte("data:" + ir.ContentType + ";base64," + base64.StdEncoding.EncodeToString(ir.Content))
+		ir.ContentType = "text/plain; charset=utf-8"
 	}
-	var r io.Reader = resp.Body
-	if i.MaxItemSize > 0 {
-		r = io.LimitReader(resp.Body, i.MaxItemSize)
+	return json.Marshal(ir)
+}
+
+// unservable tells whether err means the content of the origin can't be
+// served for good, rather than for now or because of the config.
+func unservable(err error) bool {
+	switch e := err.(type) {
+	case ContentError, ImageTooLargeError:
+		return true
+	case StatusCodeError:
+		return e.Code == http.StatusNotFound || e.Code == http.StatusGone
 	}
-	im, format, err := image.Decode(r)
+	return false
+}
+
+func (i ImageFetcher) WriteResponse(w http.ResponseWriter, cached []byte) error {
+	var ir imageResponse
+	if err := json.Unmarshal(cached, &ir); err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", ir.ContentType)
+	if ir.Fallback != "" {
+		w.Header().Set("X-Fallback", ir.Fallback)
+	}
+	if ir.Crop != "" {
+		w.Header().Set("X-Crop", ir.Crop)
+	}
+	if ir.Width > 0 {
+		w.Header().Set("X-Image-Width", strconv.Itoa(ir.Width))
+		w.Header().Set("X-Image-Height", strconv.Itoa(ir.Height))
+	}
+	_, err := w.Write(ir.Content)
+	return err
+}
+
+func (i ImageFetcher) generate(q neturl.Values) (*imageResponse, error) {
+	url := q.Get("url")
+	width, _ := strconv.Atoi(q.Get("width"))
+	height, _ := strconv.Atoi(q.Get("height"))
+	filter, linear := q.Get("filter"), q.Get("gamma") == "linear"
+	upscale := q.Get("upscale") == "true"
+	width, height = fit(max0(width), max0(height), maxRequestSize, maxRequestSize)
+	// Device pixel ratio, for high density displays.
+	if dpr, _ := strconv.Atoi(q.Get("dpr")); dpr >= 1 && dpr <= maxDPR {
+		width, height = width*dpr, height*dpr
+	}
+
+	data, err := original(url)
+	if err != nil {
+		return nil, err
+	}
+	im, format, release, err := i.Limits.Decode(data)
 	switch err {
 	case nil:
-		break
-	case image.ErrFormat, io.ErrUnexpectedEOF:
-		return nil, nil
+		defer release()
+	case image.ErrFormat:
+		return nil, ContentError{url, ContentUnsupported}
+	case io.ErrUnexpectedEOF:
+		return nil, ContentError{url, ContentTruncated}
 	default:
 		return nil, err
 	}
 
-	w, h := im.Bounds().Max.X, im.Bounds().Max.Y
-	if width > 0 && w > width {
-		w, h = width, h*width/w
-		im = Resize(im, im.Bounds(), w, h)
+	ir := &imageResponse{ContentType: "image/jpeg"}
+	rect := im.Bounds()
+	if width > 0 && height > 0 {
+		// Crop to the requested aspect ratio first.
+		rect = cropRect(im, width, height, q.Get("gravity") == "smart")
+		ir.Crop = fmt.Sprintf("%d,%d,%d,%d", rect.Min.X, rect.Min.Y, rect.Dx(), rect.Dy())
+	}
+	w, h := rect.Dx(), rect.Dy()
+	switch {
+	case width > 0 && height > 0:
+		if w > width || upscale {
+			w, h = width, height
+		}
+	case width > 0:
+		if w > width || upscale {
+			w, h = width, h*width/w
+		}
+	case height > 0:
+		if h > height || upscale {
+			w, h = w*height/h, height
+		}
+	}
+	maxWidth, maxHeight := i.MaxWidth, i.MaxHeight
+	if maxWidth <= 0 {
+		maxWidth = defaultMaxSize
+	}
+	if maxHeight <= 0 {
+		maxHeight = defaultMaxSize
+	}
+	w, h = fit(max1(w), max1(h), maxWidth, maxHeight)
+	if rect != im.Bounds() || w != rect.Dx() || h != rect.Dy() {
+		im = resize(im, rect, w, h, filter, linear)
+	}
+	ir.Width, ir.Height = w, h
+	if name := q.Get("overlay"); name != "" {
+		o := i.Overlays.Get(name)
+		if o == nil {
+			return nil, fmt.Errorf("No such overlay: %s", name)
+		}
+		// This node hasn't reloaded the overlay yet, or the requesting one.
+		if v := q.Get("_v"); v != "" && v != o.version {
+			return nil, OverlayVersionError{name}
+		}
+		im = o.Draw(im)
 	}
 
 	buf := new(bytes.Buffer)
-	if format == "png" {
+	if format == "png" || q.Get("format") == "png" || !opaque(im) {
+		ir.ContentType = "image/png"
 		err = png.Encode(buf, im)
 	} else {
 		err = jpeg.Encode(buf, im, defaultJpegOption)
 	}
-	return buf.Bytes(), err
+	ir.Content = buf.Bytes()
+	return ir, err
+}
+
+// cachedImage gets the image at u, scaled down to width, through the image group.
+// It's a PNG, so that what's derived from it isn't skewed by JPEG artifacts.
+// Placeholders don't describe the original image, so they are reported as errors.
+func cachedImage(u string, width int) (image.Image, error) {
+	q := neturl.Values{}
+	q.Set("url", u)
+	q.Set("width", strconv.Itoa(width))
+	q.Set("format", "png")
+	var buf []byte
+	if err := groupcache.GetGroup("image").Get(nil, q.Encode(), groupcache.AllocatingByteSliceSink(&buf)); err != nil {
+		return nil, err
+	}
+	var ir imageResponse
+	if err := json.Unmarshal(buf, &ir); err != nil {
+		return nil, err
+	}
+	if ir.Fallback != "" {
+		return nil, ContentError{u, ContentUnsupported}
+	}
+	m, _, err := image.Decode(bytes.NewReader(ir.Content))
+	return m, err
+}
+
+// fit scales w*h down to fit in maxW*maxH if needed, keeping the aspect
+// ratio. A side of 0 is left to be derived, other sides stay at least 1.
+func fit(w, h, maxW, maxH int) (int, int) {
+	s := 1.0
+	if w > maxW {
+		s = float64(maxW) / float64(w)
+	}
+	if h > maxH {
+		s = math.Min(s, float64(maxH)/float64(h))
+	}
+	if s < 1 {
+		if w > 0 {
+			w = max1(int(float64(w) * s))
+		}
+		if h > 0 {
+			h = max1(int(float64(h) * s))
+		}
+	}
+	return w, h
+}
+
+func max0(v int) int {
+	if v < 0 {
+		return 0
+	}
+	return v
+}
+
+// resize scales the image slice r of m to w*h with the named filter.
+// Unknown filters fall back to the box filter.
+func resize(m image.Image, r image.Rectangle, w, h int, filter string, linear bool) image.Image {
+	if filter == "nearest" {
+		return Resample(m, r, w, h)
+	}
+	f, ok := filters[filter]
+	if !ok {
+		f = BoxFilter
+	}
+	if f == BoxFilter && !linear {
+		return Resize(m, r, w, h)
+	}
+	return ResizeFilter(m, r, w, h, f, linear)
+}
+
+// opaque reports whether every pixel of m is fully opaque.
+// JPEG can't carry alpha, so transparent WebP, TIFF and BMP images are kept as PNG.
+func opaque(m image.Image) bool {
+	if o, ok := m.(interface {
+		Opaque() bool
+	}); ok {
+		return o.Opaque()
+	}
+	b := m.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if _, _, _, a := m.At(x, y).RGBA(); a != 0xffff {
+				return false
+			}
+		}
+	}
+	return true
 }
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"math"
+)
+
+const (
+	// Smart crops are scored on a copy scaled down to fit in a square this large.
+	cropSampleSize = 128
+	// Relative weights of the heuristics scoring a pixel.
+	cropEdgeWeight       = 1.0
+	cropSkinWeight       = 0.4
+	cropSaturationWeight = 0.2
+	// Weight of the luma entropy of a window, in bits, relative to its mean pixel score.
+	cropEntropyWeight = 0.05
+)
+
+// cropRect returns the largest rectangle of bounds with the aspect ratio w:h.
+// With smart set the rectangle is placed by smartCrop, otherwise centred.
+func cropRect(m image.Image, w, h int, smart bool) image.Rectangle {
+	b := m.Bounds()
+	cw, ch := b.Dx(), b.Dy()
+	if cw*h > ch*w {
+		cw = ch * w / h
+	} else {
+		ch = cw * h / w
+	}
+	if cw < 1 || ch < 1 {
+		return b
+	}
+	if smart {
+		return smartCrop(m, cw, ch)
+	}
+	min := b.Min.Add(image.Pt((b.Dx()-cw)/2, (b.Dy()-ch)/2))
+	return image.Rectangle{min, min.Add(image.Pt(cw, ch))}
+}
+
+// smartCrop slides a cw*ch window along the longer axis of m and returns the
+// one scoring best on edge density, skin tones, saturation and luma entropy.
+func smartCrop(m image.Image, cw, ch int) image.Rectangle {
+	b := m.Bounds()
+	sw, sh := fitIn(b.Dx(), b.Dy(), cropSampleSize)
+	small := Resize(m, b, sw, sh).(*image.RGBA)
+	// The sample is rounded to whole pixels, so each axis has its own scale.
+	sx, sy := float64(b.Dx())/float64(sw), float64(b.Dy())/float64(sh)
+	ww := int(math.Min(math.Max(math.Round(float64(cw)/sx), 1), float64(sw)))
+	wh := int(math.Min(math.Max(math.Round(float64(ch)/sy), 1), float64(sh)))
+
+	// Per pixel scores and luma, and a summed-area table of the scores.
+	luma := make([]uint8, sw*sh)
+	for i := range luma {
+		p := small.Pix[4*i:]
+		luma[i] = color.GrayModel.Convert(color.RGBA{p[0], p[1], p[2], p[3]}).(color.Gray).Y
+	}
+	sum := make([]float64, (sw+1)*(sh+1))
+	for y := 0; y < sh; y++ {
+		for x := 0; x < sw; x++ {
+			i := y*sw + x
+			var edge float64
+			if x+1 < sw {
+				edge += math.Abs(float64(luma[i]) - float64(luma[i+1]))
+			}
+			if y+1 < sh {
+				edge += math.Abs(float64(luma[i]) - float64(luma[i+sw]))
+			}
+			p := small.Pix[4*i:]
+			score := cropEdgeWeight*edge/255 + cropSaturationWeight*saturation(p[0], p[1], p[2])
+			if skinTone(p[0], p[1], p[2]) {
+				score += cropSkinWeight
+			}
+			sum[(y+1)*(sw+1)+x+1] = score + sum[y*(sw+1)+x+1] + sum[(y+1)*(sw+1)+x] - sum[y*(sw+1)+x]
+		}
+	}
+
+	best, bestScore := image.Point{}, math.Inf(-1)
+	for y := 0; y+wh <= sh; y++ {
+		for x := 0; x+ww <= sw; x++ {
+			s := sum[(y+wh)*(sw+1)+x+ww] - sum[y*(sw+1)+x+ww] - sum[(y+wh)*(sw+1)+x] + sum[y*(sw+1)+x]
+			s = s/float64(ww*wh) + cropEntropyWeight*entropy(luma, sw, image.Rect(x, y, x+ww, y+wh))
+			if s > bestScore {
+				best, bestScore = image.Pt(x, y), s
+			}
+		}
+	}
+
+	min := b.Min.Add(image.Pt(int(float64(best.X)*sx), int(float64(best.Y)*sy)))
+	// Keep the window inside the image despite rounding.
+	if min.X+cw > b.Max.X {
+		min.X = b.Max.X - cw
+	}
+	if min.Y+ch > b.Max.Y {
+		min.Y = b.Max.Y - ch
+	}
+	return image.Rectangle{min, min.Add(image.Pt(cw, ch))}
+}
+
+// entropy returns the Shannon entropy of the 16 bin luma histogram of r, in bits.
+func entropy(luma []uint8, stride int, r image.Rectangle) float64 {
+	var hist [16]int
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for _, v := range luma[y*stride+r.Min.X : y*stride+r.Max.X] {
+			hist[v>>4]++
+		}
+	}
+	n := float64(r.Dx() * r.Dy())
+	var e float64
+	for _, c := range hist {
+		if c > 0 {
+			p := float64(c) / n
+			e -= p * math.Log2(p)
+		}
+	}
+	return e
+}
+
+func saturation(r, g, b uint8) float64 {
+	max := math.Max(float64(r), math.Max(float64(g), float64(b)))
+	min := math.Min(float64(r), math.Min(float64(g), float64(b)))
+	if max == 0 {
+		return 0
+	}
+	return (max - min) / max
+}
+
+// skinTone is the classic RGB rule for skin under daylight.
+func skinTone(r, g, b uint8) bool {
+	min := g
+	if b < min {
+		min = b
+	}
+	return r > 95 && g > 40 && b > 20 && r > g && r > b && r-min > 15 && int(r)-int(g) > 15
+}
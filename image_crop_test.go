@@ -0,0 +1,47 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"math/rand"
+	"testing"
+)
+
+// noisyBand returns a flat grey w*h image with a band of noise starting at
+// row y0, of the given height.
+func noisyBand(w, h, y0, height int) *image.RGBA {
+	rnd := rand.New(rand.NewSource(1))
+	m := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := color.RGBA{128, 128, 128, 255}
+			if y >= y0 && y < y0+height {
+				v := uint8(rnd.Intn(256))
+				c = color.RGBA{v, v, v, 255}
+			}
+			m.SetRGBA(x, y, c)
+		}
+	}
+	return m
+}
+
+func TestSmartCrop(t *testing.T) {
+	for _, c := range []struct {
+		w, h, band int
+	}{
+		{200, 1000, 400},
+		// Scaled to a single column, the sample is scaled much less across
+		// than along the image.
+		{15, 1000, 400},
+	} {
+		m := noisyBand(c.w, c.h, c.band, c.w)
+		r := cropRect(m, 1, 1, true)
+		if r.Dx() != c.w || r.Dy() != c.w {
+			t.Errorf("%dx%d: cropped %v, want a %d pixel square", c.w, c.h, r, c.w)
+		}
+		// Within a sample pixel of the band.
+		if d := r.Min.Y - c.band; d < -10 || d > 10 {
+			t.Errorf("%dx%d: cropped %v, want the band at %d", c.w, c.h, r, c.band)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// How long an image waits for the memory to decode it by default.
+const defaultBudgetTimeout = 10 * time.Second
+
+// ImageTooLargeError is returned for images declaring more pixels than allowed.
+type ImageTooLargeError struct {
+	Width, Height int
+}
+
+func (e ImageTooLargeError) Error() string {
+	return fmt.Sprintf("Image too large: %dx%d", e.Width, e.Height)
+}
+
+func (e ImageTooLargeError) StatusCode() int {
+	return http.StatusRequestEntityTooLarge
+}
+
+// DecodeBusyError is returned when an image waited too long for the memory
+// to decode it, as others were being decoded.
+type DecodeBusyError struct {
+	Width, Height int
+}
+
+func (e DecodeBusyError) Error() string {
+	return fmt.Sprintf("Too busy to decode image: %dx%d", e.Width, e.Height)
+}
+
+func (e DecodeBusyError) StatusCode() int {
+	return http.StatusServiceUnavailable
+}
+
+// DecodeLimits guards image decoding against decompression bombs.
+// Zero values mean no limit.
+type DecodeLimits struct {
+	// Maximum Width*Height of an image.
+	MaxPixels int64
+	// Maximum Width or Height of an image.
+	MaxDimension int
+	// Shared budget for the memory of images being decoded concurrently.
+	Budget *MemoryBudget
+	// How long to wait for the budget, defaultBudgetTimeout if 0.
+	BudgetTimeout time.Duration
+}
+
+// Decode checks the header of data against the limits before decoding it.
+// The returned release function must be called once the image is no longer used.
+func (l DecodeLimits) Decode(data []byte) (m image.Image, format string, release func(), err error) {
+	c, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", nil, err
+	}
+	if c.Width < 0 || c.Height < 0 ||
+		l.MaxDimension > 0 && (c.Width > l.MaxDimension || c.Height > l.MaxDimension) ||
+		l.MaxPixels > 0 && int64(c.Width)*int64(c.Height) > l.MaxPixels {
+		return nil, "", nil, ImageTooLargeError{c.Width, c.Height}
+	}
+	size := bytesPerPixel(c.ColorModel) * int64(c.Width) * int64(c.Height)
+	timeout := l.BudgetTimeout
+	if timeout <= 0 {
+		timeout = defaultBudgetTimeout
+	}
+	if !l.Budget.Acquire(size, timeout) {
+		return nil, "", nil, DecodeBusyError{c.Width, c.Height}
+	}
+	release = func() { l.Budget.Release(size) }
+	m, format, err = image.Decode(bytes.NewReader(data))
+	if err != nil {
+		release()
+		return nil, "", nil, err
+	}
+	return m, format, release, nil
+}
+
+// bytesPerPixel estimates the memory per pixel of an image decoded in
+// colour model m. Subsampled YCbCr takes less than counted, as the
+// subsampling isn't known before decoding.
+func bytesPerPixel(m color.Model) int64 {
+	switch m {
+	case color.GrayModel, color.AlphaModel:
+		return 1
+	case color.Gray16Model, color.Alpha16Model:
+		return 2
+	case color.YCbCrModel:
+		return 3
+	case color.RGBA64Model, color.NRGBA64Model:
+		return 8
+	}
+	if _, ok := m.(color.Palette); ok {
+		return 1
+	}
+	return 4
+}
+
+// MemoryBudget is a counting semaphore measured in bytes.
+// A nil *MemoryBudget has no limit.
+type MemoryBudget struct {
+	mu         sync.Mutex
+	free, size int64
+	// Closed and replaced whenever bytes are released.
+	released chan struct{}
+}
+
+func NewMemoryBudget(size int64) *MemoryBudget {
+	return &MemoryBudget{free: size, size: size, released: make(chan struct{})}
+}
+
+// Acquire waits until n bytes are available, for up to timeout, and tells
+// whether they were acquired. Requests larger than the whole budget wait
+// for it to be entirely free.
+func (b *MemoryBudget) Acquire(n int64, timeout time.Duration) bool {
+	if b == nil {
+		return true
+	}
+	if n > b.size {
+		n = b.size
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	b.mu.Lock()
+	for b.free < n {
+		released := b.released
+		b.mu.Unlock()
+		select {
+		case <-released:
+		case <-timer.C:
+			return false
+		}
+		b.mu.Lock()
+	}
+	b.free -= n
+	b.mu.Unlock()
+	return true
+}
+
+// Release returns n bytes acquired earlier.
+func (b *MemoryBudget) Release(n int64) {
+	if b == nil {
+		return
+	}
+	if n > b.size {
+		n = b.size
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.free += n
+	close(b.released)
+	b.released = make(chan struct{})
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"testing"
+	"time"
+)
+
+func TestMemoryBudget(t *testing.T) {
+	b := NewMemoryBudget(100)
+	if !b.Acquire(60, time.Second) {
+		t.Fatal("free budget not acquired")
+	}
+	if b.Acquire(60, 20*time.Millisecond) {
+		t.Fatal("budget acquired past its size")
+	}
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		b.Release(60)
+	}()
+	if !b.Acquire(60, time.Second) {
+		t.Fatal("budget not acquired once released")
+	}
+	// Larger than the whole budget, it waits for all of it.
+	if b.Acquire(1000, 20*time.Millisecond) {
+		t.Fatal("whole budget acquired while in use")
+	}
+	b.Release(60)
+	if !b.Acquire(1000, time.Second) {
+		t.Fatal("whole budget not acquired while free")
+	}
+}
+
+func TestDecodeBusy(t *testing.T) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 100, 100))); err != nil {
+		t.Fatal(err)
+	}
+	// A gray image takes a byte per pixel.
+	l := DecodeLimits{Budget: NewMemoryBudget(15000), BudgetTimeout: 20 * time.Millisecond}
+	_, _, release, err := l.Decode(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, _, err = l.Decode(buf.Bytes())
+	if e, ok := err.(DecodeBusyError); !ok || e.StatusCode() != 503 {
+		t.Fatalf("got %v decoding past the budget, want a DecodeBusyError", err)
+	}
+	release()
+	if _, _, release, err = l.Decode(buf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	release()
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"runtime"
+	"sync"
+)
+
+// Filter is a separable resampling kernel.
+type Filter struct {
+	// Support is the radius of the kernel, in source pixels when not scaling.
+	Support float64
+	Kernel  func(x float64) float64
+}
+
+var (
+	BoxFilter = &Filter{0.5, func(x float64) float64 {
+		if x >= -0.5 && x < 0.5 {
+			return 1
+		}
+		return 0
+	}}
+	BilinearFilter = &Filter{1, func(x float64) float64 {
+		x = math.Abs(x)
+		if x < 1 {
+			return 1 - x
+		}
+		return 0
+	}}
+	CatmullRomFilter = &Filter{2, func(x float64) float64 {
+		x = math.Abs(x)
+		switch {
+		case x < 1:
+			return (1.5*x-2.5)*x*x + 1
+		case x < 2:
+			return ((-0.5*x+2.5)*x-4)*x + 2
+		}
+		return 0
+	}}
+	LanczosFilter = &Filter{3, func(x float64) float64 {
+		x = math.Abs(x)
+		if x < 3 {
+			return sinc(x) * sinc(x/3)
+		}
+		return 0
+	}}
+)
+
+// filters maps the values accepted by the filter= query to kernels.
+var filters = map[string]*Filter{
+	"box":        BoxFilter,
+	"bilinear":   BilinearFilter,
+	"catmullrom": CatmullRomFilter,
+	"lanczos":    LanczosFilter,
+}
+
+func sinc(x float64) float64 {
+	if x == 0 {
+		return 1
+	}
+	x *= math.Pi
+	return math.Sin(x) / x
+}
+
+// contrib lists the weights of the source pixels starting at start for one destination pixel.
+type contrib struct {
+	start   int
+	weights []float32
+}
+
+// contribs computes the filter weights for scaling n source pixels to m destination pixels.
+func contribs(n, m int, f *Filter) []contrib {
+	scale := float64(n) / float64(m)
+	fscale := math.Max(scale, 1)
+	support := f.Support * fscale
+	ret := make([]contrib, m)
+	for i := range ret {
+		center := (float64(i)+0.5)*scale - 0.5
+		left := int(math.Ceil(center - support))
+		right := int(math.Floor(center + support))
+		if left < 0 {
+			left = 0
+		}
+		if right > n-1 {
+			right = n - 1
+		}
+		if right < left {
+			// The kernel is narrower than a source pixel; take the nearest one.
+			left = int(math.Min(math.Max(math.Floor(center+0.5), 0), float64(n-1)))
+			right = left
+		}
+		weights := make([]float32, right-left+1)
+		var sum float64
+		for j := left; j <= right; j++ {
+			w := f.Kernel((float64(j) - center) / fscale)
+			weights[j-left] = float32(w)
+			sum += w
+		}
+		if sum == 0 {
+			weights[0], sum = 1, 1
+		}
+		for j := range weights {
+			weights[j] /= float32(sum)
+		}
+		ret[i] = contrib{left, weights}
+	}
+	return ret
+}
+
+// ResizeFilter returns a scaled copy of the image slice r of m, using the
+// separable filter f. If linear is set, the filtering is done in linear light
+// instead of sRGB.
+// The returned image has width w and height h.
+func ResizeFilter(m image.Image, r image.Rectangle, w, h int, f *Filter, linear bool) image.Image {
+	if w < 0 || h < 0 {
+		return nil
+	}
+	if w == 0 || h == 0 || r.Dx() <= 0 || r.Dy() <= 0 {
+		return image.NewRGBA64(image.Rect(0, 0, w, h))
+	}
+	return resample(m, r, w, h, contribs(r.Dx(), w, f), contribs(r.Dy(), h, f), linear)
+}
+
+// minBandRows is the fewest destination rows worth handing to a goroutine.
+const minBandRows = 16
+
+// resample scales the image slice r of m to w*h with the weights cx and cy.
+// The destination rows are split into bands, one goroutine each. A band
+// streams through the source rows it needs, keeping only as many filtered
+// rows as its vertical kernel spans, so memory stays proportional to w
+// rather than to the source size.
+func resample(m image.Image, r image.Rectangle, w, h int, cx, cy []contrib, linear bool) *image.RGBA {
+	ret := image.NewRGBA(image.Rect(0, 0, w, h))
+	read := rowReader(m, linear)
+	band := (h + runtime.GOMAXPROCS(0) - 1) / runtime.GOMAXPROCS(0)
+	if band < minBandRows {
+		band = minBandRows
+	}
+	var wg sync.WaitGroup
+	for y0 := 0; y0 < h; y0 += band {
+		y1 := y0 + band
+		if y1 > h {
+			y1 = h
+		}
+		wg.Add(1)
+		go func(y0, y1 int) {
+			defer wg.Done()
+			resampleRows(ret, read, r, cx, cy[y0:y1], y0, linear)
+		}(y0, y1)
+	}
+	wg.Wait()
+	return ret
+}
+
+// resampleRows fills the destination rows starting at y0, one per entry of cy.
+func resampleRows(dst *image.RGBA, read func(x, y int, row []float32), r image.Rectangle, cx, cy []contrib, y0 int, linear bool) {
+	w := len(cx)
+	window := 0
+	for _, c := range cy {
+		if len(c.weights) > window {
+			window = len(c.weights)
+		}
+	}
+	// ring holds horizontally filtered source rows, row j at j%window.
+	// Row starts never decrease, so a row is only overwritten once no
+	// destination row below needs it.
+	row := make([]float32, 4*r.Dx())
+	ring := make([]float32, 4*w*window)
+	next := cy[0].start
+	for i, c := range cy {
+		if next < c.start {
+			next = c.start
+		}
+		for ; next < c.start+len(c.weights); next++ {
+			read(r.Min.X, r.Min.Y+next, row)
+			filterRow(ring[4*w*(next%window):], row, cx)
+		}
+		out := dst.Pix[dst.PixOffset(0, y0+i):]
+		for x := 0; x < w; x++ {
+			var r, g, b, a float32
+			for k, wt := range c.weights {
+				in := ring[4*(w*((c.start+k)%window)+x):]
+				r += in[0] * wt
+				g += in[1] * wt
+				b += in[2] * wt
+				a += in[3] * wt
+			}
+			p := toRGBA(r, g, b, a, linear)
+			out[4*x+0], out[4*x+1], out[4*x+2], out[4*x+3] = p.R, p.G, p.B, p.A
+		}
+	}
+}
+
+// filterRow filters the source row in to len(cx) pixels in out.
+func filterRow(out, in []float32, cx []contrib) {
+	for x, c := range cx {
+		var r, g, b, a float32
+		p := in[4*c.start:]
+		for i, wt := range c.weights {
+			r += p[4*i+0] * wt
+			g += p[4*i+1] * wt
+			b += p[4*i+2] * wt
+			a += p[4*i+3] * wt
+		}
+		out[4*x+0], out[4*x+1], out[4*x+2], out[4*x+3] = r, g, b, a
+	}
+}
+
+// rowReader returns a function that reads len(row)/4 pixels of m starting at
+// (x, y) into row, as premultiplied RGBA in [0, 1].
+func rowReader(m image.Image, linear bool) func(x, y int, row []float32) {
+	switch m := m.(type) {
+	case *image.RGBA:
+		return func(x, y int, row []float32) {
+			pix := m.Pix[m.PixOffset(x, y):]
+			for i := 0; i < len(row); i += 4 {
+				a := uint32(pix[i+3]) * 0x101
+				storePixel(row[i:], uint32(pix[i])*0x101, uint32(pix[i+1])*0x101, uint32(pix[i+2])*0x101, a, linear)
+			}
+		}
+	case *image.YCbCr:
+		// YOffset and COffset take care of every subsample ratio.
+		return func(x, y int, row []float32) {
+			for i := 0; i < len(row); i, x = i+4, x+1 {
+				r8, g8, b8 := color.YCbCrToRGB(m.Y[m.YOffset(x, y)], m.Cb[m.COffset(x, y)], m.Cr[m.COffset(x, y)])
+				storePixel(row[i:], uint32(r8)*0x101, uint32(g8)*0x101, uint32(b8)*0x101, 0xffff, linear)
+			}
+		}
+	}
+	return func(x, y int, row []float32) {
+		for i := 0; i < len(row); i, x = i+4, x+1 {
+			r, g, b, a := m.At(x, y).RGBA()
+			storePixel(row[i:], r, g, b, a, linear)
+		}
+	}
+}
+
+// storePixel stores a 16-bit premultiplied colour into dst as floats.
+func storePixel(dst []float32, r, g, b, a uint32, linear bool) {
+	if !linear {
+		dst[0] = float32(r) / 0xffff
+		dst[1] = float32(g) / 0xffff
+		dst[2] = float32(b) / 0xffff
+		dst[3] = float32(a) / 0xffff
+		return
+	}
+	if a == 0 {
+		dst[0], dst[1], dst[2], dst[3] = 0, 0, 0, 0
+		return
+	}
+	lut := linearLUT()
+	fa := float32(a) / 0xffff
+	dst[0] = lut[unpremultiply(r, a)] * fa
+	dst[1] = lut[unpremultiply(g, a)] * fa
+	dst[2] = lut[unpremultiply(b, a)] * fa
+	dst[3] = fa
+}
+
+func unpremultiply(c, a uint32) uint32 {
+	if c >= a {
+		return 0xffff
+	}
+	return c * 0xffff / a
+}
+
+// toRGBA converts a filtered premultiplied pixel back to 8-bit sRGB.
+func toRGBA(r, g, b, a float32, linear bool) color.RGBA {
+	a = clamp01(a)
+	if linear {
+		if a == 0 {
+			return color.RGBA{}
+		}
+		lut := srgbLUT()
+		r = lut[int(clamp01(r/a)*float32(len(lut)-1)+0.5)] * a
+		g = lut[int(clamp01(g/a)*float32(len(lut)-1)+0.5)] * a
+		b = lut[int(clamp01(b/a)*float32(len(lut)-1)+0.5)] * a
+	}
+	return color.RGBA{
+		uint8(math.Min(float64(clamp01(r)), float64(a))*255 + 0.5),
+		uint8(math.Min(float64(clamp01(g)), float64(a))*255 + 0.5),
+		uint8(math.Min(float64(clamp01(b)), float64(a))*255 + 0.5),
+		uint8(a*255 + 0.5),
+	}
+}
+
+func clamp01(v float32) float32 {
+	if v < 0 {
+		return 0
+	}
+	if v > 1 {
+		return 1
+	}
+	return v
+}
+
+var (
+	linearOnce, srgbOnce   sync.Once
+	linearTable, srgbTable []float32
+)
+
+// linearLUT maps 16-bit sRGB values to linear light.
+func linearLUT() []float32 {
+	linearOnce.Do(func() {
+		linearTable = make([]float32, 0x10000)
+		for i := range linearTable {
+			v := float64(i) / 0xffff
+			if v <= 0.04045 {
+				v /= 12.92
+			} else {
+				v = math.Pow((v+0.055)/1.055, 2.4)
+			}
+			linearTable[i] = float32(v)
+		}
+	})
+	return linearTable
+}
+
+// srgbLUT maps linear light, quantized to 12 bits, back to sRGB.
+func srgbLUT() []float32 {
+	srgbOnce.Do(func() {
+		srgbTable = make([]float32, 0x1000)
+		for i := range srgbTable {
+			v := float64(i) / 0xfff
+			if v <= 0.0031308 {
+				v *= 12.92
+			} else {
+				v = 1.055*math.Pow(v, 1/2.4) - 0.055
+			}
+			srgbTable[i] = float32(v)
+		}
+	})
+	return srgbTable
+}
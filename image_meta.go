@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"image/color"
+	"io"
+)
+
+// colorModelName names the standard colour models.
+func colorModelName(m color.Model) string {
+	switch m {
+	case color.RGBAModel:
+		return "rgba"
+	case color.RGBA64Model:
+		return "rgba64"
+	case color.NRGBAModel:
+		return "nrgba"
+	case color.NRGBA64Model:
+		return "nrgba64"
+	case color.AlphaModel:
+		return "alpha"
+	case color.Alpha16Model:
+		return "alpha16"
+	case color.GrayModel:
+		return "gray"
+	case color.Gray16Model:
+		return "gray16"
+	case color.CMYKModel:
+		return "cmyk"
+	case color.YCbCrModel:
+		return "ycbcr"
+	case color.NYCbCrAModel:
+		return "nycbcra"
+	}
+	if _, ok := m.(color.Palette); ok {
+		return "paletted"
+	}
+	return "unknown"
+}
+
+// jpegOrientation finds the EXIF orientation in the segments of a JPEG
+// preceding the image data. It returns 0 if there is none.
+func jpegOrientation(b []byte) int {
+	if len(b) < 2 || b[0] != 0xff || b[1] != 0xd8 {
+		return 0
+	}
+	b = b[2:]
+	for len(b) >= 4 && b[0] == 0xff {
+		marker := b[1]
+		n := int(binary.BigEndian.Uint16(b[2:]))
+		if marker == 0xda || n < 2 || len(b) < 2+n {
+			// Start of scan, or not enough of the file.
+			return 0
+		}
+		seg := b[4 : 2+n]
+		if marker == 0xe1 && len(seg) > 6 && string(seg[:6]) == "Exif\x00\x00" {
+			return tiffOrientation(seg[6:])
+		}
+		b = b[2+n:]
+	}
+	return 0
+}
+
+// tiffOrientation reads the orientation tag of the first IFD of a TIFF
+// structure, as found in TIFF files and EXIF blocks. It returns 0 if there is none.
+func tiffOrientation(b []byte) int {
+	if len(b) < 8 {
+		return 0
+	}
+	var order binary.ByteOrder
+	switch string(b[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0
+	}
+	ifd := int(order.Uint32(b[4:]))
+	if ifd < 8 || ifd+2 > len(b) {
+		return 0
+	}
+	entries := int(order.Uint16(b[ifd:]))
+	for i := 0; i < entries; i++ {
+		e := ifd + 2 + 12*i
+		if e+12 > len(b) {
+			return 0
+		}
+		if order.Uint16(b[e:]) == 0x0112 {
+			if o := int(order.Uint16(b[e+8:])); o >= 1 && o <= 8 {
+				return o
+			}
+			return 0
+		}
+	}
+	return 0
+}
+
+// gifFrames counts the frames of a GIF by walking its blocks, skipping
+// over the image data without decompressing it. It stops once it has
+// counted max frames, if max is positive, not to read the rest.
+func gifFrames(r io.Reader, max int) (frames int, err error) {
+	br := bufio.NewReader(r)
+	var header [13]byte
+	if _, err = io.ReadFull(br, header[:]); err != nil {
+		return
+	}
+	if header[10]&0x80 != 0 {
+		if err = skip(br, 3<<(header[10]&7+1)); err != nil {
+			return
+		}
+	}
+	for {
+		var c byte
+		if c, err = br.ReadByte(); err == io.EOF {
+			// The trailer is missing, but the frames are complete.
+			return frames, nil
+		} else if err != nil {
+			return
+		}
+		switch c {
+		case 0x2c: // Image descriptor
+			var desc [9]byte
+			if _, err = io.ReadFull(br, desc[:]); err != nil {
+				return
+			}
+			if desc[8]&0x80 != 0 {
+				if err = skip(br, 3<<(desc[8]&7+1)); err != nil {
+					return
+				}
+			}
+			// LZW minimum code size.
+			if _, err = br.ReadByte(); err != nil {
+				return
+			}
+			if err = skipSubBlocks(br); err != nil {
+				return
+			}
+			if frames++; frames == max {
+				return
+			}
+		case 0x21: // Extension
+			if _, err = br.ReadByte(); err != nil {
+				return
+			}
+			if err = skipSubBlocks(br); err != nil {
+				return
+			}
+		case 0x3b: // Trailer
+			return frames, nil
+		default:
+			// Garbage after the last frame is common, don't fail on it.
+			return frames, nil
+		}
+	}
+}
+
+func skip(br *bufio.Reader, n int) error {
+	_, err := br.Discard(n)
+	return err
+}
+
+func skipSubBlocks(br *bufio.Reader) error {
+	for {
+		n, err := br.ReadByte()
+		if err != nil || n == 0 {
+			return err
+		}
+		if err := skip(br, int(n)); err != nil {
+			return err
+		}
+	}
+}
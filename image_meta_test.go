@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	colorpalette "image/color/palette"
+	"image/gif"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+// tiffWithOrientation returns a TIFF structure whose first IFD has a tag
+// before the orientation, or no orientation if it's 0.
+func tiffWithOrientation(order binary.ByteOrder, orientation int) []byte {
+	var b bytes.Buffer
+	if order == binary.LittleEndian {
+		b.WriteString("II")
+	} else {
+		b.WriteString("MM")
+	}
+	binary.Write(&b, order, uint16(42))
+	binary.Write(&b, order, uint32(8))
+	entries := []uint16{0x010f}
+	if orientation > 0 {
+		entries = append(entries, 0x0112)
+	}
+	binary.Write(&b, order, uint16(len(entries)))
+	for _, tag := range entries {
+		// Tag, SHORT type, count 1, value padded to 4 bytes.
+		binary.Write(&b, order, []uint16{tag, 3})
+		binary.Write(&b, order, uint32(1))
+		binary.Write(&b, order, []uint16{uint16(orientation), 0})
+	}
+	binary.Write(&b, order, uint32(0))
+	return b.Bytes()
+}
+
+func jpegSegment(marker byte, data []byte) []byte {
+	seg := []byte{0xff, marker, 0, 0}
+	binary.BigEndian.PutUint16(seg[2:], uint16(2+len(data)))
+	return append(seg, data...)
+}
+
+func TestTIFFOrientation(t *testing.T) {
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		for _, o := range []int{0, 1, 6, 8} {
+			if got := tiffOrientation(tiffWithOrientation(order, o)); got != o {
+				t.Errorf("%v orientation %d: got %d", order, o, got)
+			}
+		}
+		b := tiffWithOrientation(order, 6)
+		if got := tiffOrientation(b[:len(b)-10]); got != 0 {
+			t.Errorf("%v truncated: got %d", order, got)
+		}
+	}
+	if got := tiffOrientation([]byte("XX*\x00\x08\x00\x00\x00")); got != 0 {
+		t.Errorf("bad byte order: got %d", got)
+	}
+}
+
+func TestJPEGOrientation(t *testing.T) {
+	exif := append([]byte("Exif\x00\x00"), tiffWithOrientation(binary.BigEndian, 6)...)
+	jfif := jpegSegment(0xe0, []byte("JFIF\x00\x01\x02\x00\x00\x01\x00\x01\x00\x00"))
+	sos := jpegSegment(0xda, []byte{1, 2, 3})
+	soi := []byte{0xff, 0xd8}
+	join := func(parts ...[]byte) []byte { return bytes.Join(parts, nil) }
+	for _, c := range []struct {
+		name string
+		b    []byte
+		want int
+	}{
+		{"exif", join(soi, jpegSegment(0xe1, exif), sos), 6},
+		{"exif after jfif", join(soi, jfif, jpegSegment(0xe1, exif), sos), 6},
+		{"no exif", join(soi, jfif, sos), 0},
+		{"exif after scan", join(soi, sos, jpegSegment(0xe1, exif)), 0},
+		{"truncated", join(soi, jpegSegment(0xe1, exif))[:20], 0},
+		{"not jpeg", []byte("GIF89a"), 0},
+	} {
+		if got := jpegOrientation(c.b); got != c.want {
+			t.Errorf("%s: got %d, want %d", c.name, got, c.want)
+		}
+	}
+}
+
+// countingReader counts the bytes read.
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+	return n, err
+}
+
+func testGIF(t *testing.T, frames int) []byte {
+	rnd := rand.New(rand.NewSource(1))
+	g := new(gif.GIF)
+	for i := 0; i < frames; i++ {
+		// Noise doesn't compress, so that frames are large.
+		m := image.NewPaletted(image.Rect(0, 0, 200, 200), colorpalette.Plan9)
+		rnd.Read(m.Pix)
+		g.Image = append(g.Image, m)
+		g.Delay = append(g.Delay, 10)
+	}
+	var b bytes.Buffer
+	if err := gif.EncodeAll(&b, g); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func TestGIFFrames(t *testing.T) {
+	for _, n := range []int{1, 3} {
+		frames, err := gifFrames(bytes.NewReader(testGIF(t, n)), 0)
+		if err != nil || frames != n {
+			t.Errorf("%d frames: got %d, %v", n, frames, err)
+		}
+	}
+
+	// Stopping at the second frame leaves the rest unread.
+	b := testGIF(t, 10)
+	r := &countingReader{r: bytes.NewReader(b)}
+	frames, err := gifFrames(r, 2)
+	if err != nil || frames != 2 {
+		t.Errorf("up to 2 frames: got %d, %v", frames, err)
+	}
+	if r.n > len(b)/2 {
+		t.Errorf("read %d bytes of %d for 2 frames of 10", r.n, len(b))
+	}
+
+	if _, err := gifFrames(bytes.NewReader(b[:len(b)/2]), 0); err == nil {
+		t.Error("no error for a truncated GIF")
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+
+	"github.com/golang/groupcache"
+)
+
+// originalGroup caches the source bytes of images, which all the variants
+// of an image are derived from.
+const originalGroup = "image_original"
+
+// OriginalFetcher downloads the source of an image, unmodified.
+type OriginalFetcher struct {
+	MaxItemSize int64
+	Client      *http.Client
+
+	DumpContentResponse
+}
+
+func (o OriginalFetcher) Generate(q url.Values) (content []byte, err error) {
+	u := q.Get("url")
+	resp, err := o.Client.Get(u)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, StatusCodeError{u, resp.StatusCode}
+	}
+	if o.MaxItemSize > 0 && resp.ContentLength > o.MaxItemSize {
+		return nil, ContentError{u, ContentTooLarge}
+	}
+	var r io.Reader = resp.Body
+	if o.MaxItemSize > 0 {
+		// Read one byte more to tell a truncated read from a complete one.
+		r = io.LimitReader(resp.Body, o.MaxItemSize+1)
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if o.MaxItemSize > 0 && int64(len(data)) > o.MaxItemSize {
+		return nil, ContentError{u, ContentTooLarge}
+	}
+	return data, nil
+}
+
+// original gets the source bytes of the image at u through the original group.
+func original(u string) ([]byte, error) {
+	q := url.Values{}
+	q.Set("url", u)
+	var buf []byte
+	err := groupcache.GetGroup(originalGroup).Get(nil, q.Encode(), groupcache.AllocatingByteSliceSink(&buf))
+	return buf, err
+}
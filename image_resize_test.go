@@ -0,0 +1,300 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math/rand"
+	"testing"
+)
+
+var subsampleRatios = []image.YCbCrSubsampleRatio{
+	image.YCbCrSubsampleRatio444,
+	image.YCbCrSubsampleRatio422,
+	image.YCbCrSubsampleRatio420,
+	image.YCbCrSubsampleRatio440,
+	image.YCbCrSubsampleRatio411,
+	image.YCbCrSubsampleRatio410,
+}
+
+// noiseYCbCr returns a w*h image of random pixels.
+func noiseYCbCr(w, h int, ratio image.YCbCrSubsampleRatio) *image.YCbCr {
+	m := image.NewYCbCr(image.Rect(0, 0, w, h), ratio)
+	rnd := rand.New(rand.NewSource(1))
+	for _, p := range [][]uint8{m.Y, m.Cb, m.Cr} {
+		rnd.Read(p)
+	}
+	return m
+}
+
+func toRGBAImage(m image.Image) *image.RGBA {
+	ret := image.NewRGBA(m.Bounds())
+	draw.Draw(ret, ret.Bounds(), m, m.Bounds().Min, draw.Src)
+	return ret
+}
+
+func TestResizeYCbCr(t *testing.T) {
+	for _, ratio := range subsampleRatios {
+		for _, size := range [][4]int{{97, 61, 31, 17}, {64, 48, 64, 48}, {33, 45, 50, 70}, {1000, 7, 3, 2}} {
+			m := noiseYCbCr(size[0], size[1], ratio)
+			r := m.Bounds()
+			got := Resize(m, r, size[2], size[3]).(*image.RGBA)
+			// The YCbCr path must agree with resizing the same pixels as RGBA.
+			want := Resize(toRGBAImage(m), r, size[2], size[3]).(*image.RGBA)
+			for i := range got.Pix {
+				if got.Pix[i] != want.Pix[i] {
+					t.Fatalf("%v %v: pixel byte %d is %d, RGBA gives %d", ratio, size, i, got.Pix[i], want.Pix[i])
+				}
+			}
+			// The baseline truncated where the resampler rounds. It's given
+			// the same pixels, as it converted some subsample ratios to RGB
+			// with more precision, by At.
+			old := baselineResize(toRGBAImage(m), r, size[2], size[3]).(*image.RGBA)
+			for i := range got.Pix {
+				if d := int(got.Pix[i]) - int(old.Pix[i]); d < -1 || d > 1 {
+					t.Fatalf("%v %v: pixel byte %d is %d, baseline gives %d", ratio, size, i, got.Pix[i], old.Pix[i])
+				}
+			}
+		}
+	}
+}
+
+func BenchmarkResize(b *testing.B) {
+	// About 20 megapixels, to a typical display size.
+	const w, h, dw, dh = 5472, 3648, 1024, 683
+	sources := []struct {
+		name string
+		m    image.Image
+	}{
+		{"RGBA", toRGBAImage(noiseYCbCr(w, h, image.YCbCrSubsampleRatio444))},
+		{"YCbCr420", noiseYCbCr(w, h, image.YCbCrSubsampleRatio420)},
+		{"YCbCr444", noiseYCbCr(w, h, image.YCbCrSubsampleRatio444)},
+		{"YCbCr410", noiseYCbCr(w, h, image.YCbCrSubsampleRatio410)},
+	}
+	for _, s := range sources {
+		for _, impl := range []struct {
+			name   string
+			resize func(image.Image, image.Rectangle, int, int) image.Image
+		}{{"baseline", baselineResize}, {"banded", Resize}} {
+			b.Run(fmt.Sprintf("%s/%s", s.name, impl.name), func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					impl.resize(s.m, s.m.Bounds(), dw, dh)
+				}
+			})
+		}
+	}
+}
+
+// The box resize before resizing was banded, for comparison.
+
+// baselineResize returns a scaled copy of the image slice r of m.
+// The returned image has width w and height h.
+func baselineResize(m image.Image, r image.Rectangle, w, h int) image.Image {
+	if w < 0 || h < 0 {
+		return nil
+	}
+	if w == 0 || h == 0 || r.Dx() <= 0 || r.Dy() <= 0 {
+		return image.NewRGBA64(image.Rect(0, 0, w, h))
+	}
+	switch m := m.(type) {
+	case *image.RGBA:
+		return baselineResizeRGBA(m, r, w, h)
+	case *image.YCbCr:
+		if m, ok := baselineResizeYCbCr(m, r, w, h); ok {
+			return m
+		}
+	}
+	ww, hh := uint64(w), uint64(h)
+	dx, dy := uint64(r.Dx()), uint64(r.Dy())
+	// The scaling algorithm is to nearest-neighbor magnify the dx * dy source
+	// to a (ww*dx) * (hh*dy) intermediate image and then minify the intermediate
+	// image back down to a ww * hh destination with a simple box filter.
+	// The intermediate image is implied, we do not physically allocate a slice
+	// of length ww*dx*hh*dy.
+	// For example, consider a 4*3 source image. Label its pixels from a-l:
+	//	abcd
+	//	efgh
+	//	ijkl
+	// To resize this to a 3*2 destination image, the intermediate is 12*6.
+	// Whitespace has been added to delineate the destination pixels:
+	//	aaab bbcc cddd
+	//	aaab bbcc cddd
+	//	eeef ffgg ghhh
+	//
+	//	eeef ffgg ghhh
+	//	iiij jjkk klll
+	//	iiij jjkk klll
+	// Thus, the 'b' source pixel contributes one third of its value to the
+	// (0, 0) destination pixel and two thirds to (1, 0).
+	// The implementation is a two-step process. First, the source pixels are
+	// iterated over and each source pixel's contribution to 1 or more
+	// destination pixels are summed. Second, the sums are divided by a scaling
+	// factor to yield the destination pixels.
+	// TODO: By interleaving the two steps, instead of doing all of
+	// step 1 first and all of step 2 second, we could allocate a smaller sum
+	// slice of length 4*w*2 instead of 4*w*h, although the resultant code
+	// would become more complicated.
+	n, sum := dx*dy, make([]uint64, 4*w*h)
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			// Get the source pixel.
+			r32, g32, b32, a32 := m.At(x, y).RGBA()
+			r64 := uint64(r32)
+			g64 := uint64(g32)
+			b64 := uint64(b32)
+			a64 := uint64(a32)
+			// Spread the source pixel over 1 or more destination rows.
+			py := uint64(y) * hh
+			for remy := hh; remy > 0; {
+				qy := dy - (py % dy)
+				if qy > remy {
+					qy = remy
+				}
+				// Spread the source pixel over 1 or more destination columns.
+				px := uint64(x) * ww
+				index := 4 * ((py/dy)*ww + (px / dx))
+				for remx := ww; remx > 0; {
+					qx := dx - (px % dx)
+					if qx > remx {
+						qx = remx
+					}
+					sum[index+0] += r64 * qx * qy
+					sum[index+1] += g64 * qx * qy
+					sum[index+2] += b64 * qx * qy
+					sum[index+3] += a64 * qx * qy
+					index += 4
+					px += qx
+					remx -= qx
+				}
+				py += qy
+				remy -= qy
+			}
+		}
+	}
+	return baselineAverage(sum, w, h, n*0x0101)
+}
+
+// baselineAverage convert the sums to averages and returns the result.
+func baselineAverage(sum []uint64, w, h int, n uint64) image.Image {
+	ret := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			index := 4 * (y*w + x)
+			ret.SetRGBA(x, y, color.RGBA{
+				uint8(sum[index+0] / n),
+				uint8(sum[index+1] / n),
+				uint8(sum[index+2] / n),
+				uint8(sum[index+3] / n),
+			})
+		}
+	}
+	return ret
+}
+
+// baselineResizeYCbCr returns a scaled copy of the YCbCr image slice r of m.
+// The returned image has width w and height h.
+func baselineResizeYCbCr(m *image.YCbCr, r image.Rectangle, w, h int) (image.Image, bool) {
+	var verticalRes int
+	switch m.SubsampleRatio {
+	case image.YCbCrSubsampleRatio420:
+		verticalRes = 2
+	case image.YCbCrSubsampleRatio422:
+		verticalRes = 1
+	default:
+		return nil, false
+	}
+	ww, hh := uint64(w), uint64(h)
+	dx, dy := uint64(r.Dx()), uint64(r.Dy())
+	// See comment in baselineResize.
+	n, sum := dx*dy, make([]uint64, 4*w*h)
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		Y := m.Y[y*m.YStride:]
+		Cb := m.Cb[y/verticalRes*m.CStride:]
+		Cr := m.Cr[y/verticalRes*m.CStride:]
+		for x := r.Min.X; x < r.Max.X; x++ {
+			// Get the source pixel.
+			r8, g8, b8 := color.YCbCrToRGB(Y[x], Cb[x/2], Cr[x/2])
+			r64 := uint64(r8)
+			g64 := uint64(g8)
+			b64 := uint64(b8)
+			// Spread the source pixel over 1 or more destination rows.
+			py := uint64(y) * hh
+			for remy := hh; remy > 0; {
+				qy := dy - (py % dy)
+				if qy > remy {
+					qy = remy
+				}
+				// Spread the source pixel over 1 or more destination columns.
+				px := uint64(x) * ww
+				index := 4 * ((py/dy)*ww + (px / dx))
+				for remx := ww; remx > 0; {
+					qx := dx - (px % dx)
+					if qx > remx {
+						qx = remx
+					}
+					qxy := qx * qy
+					sum[index+0] += r64 * qxy
+					sum[index+1] += g64 * qxy
+					sum[index+2] += b64 * qxy
+					sum[index+3] += 0xFFFF * qxy
+					index += 4
+					px += qx
+					remx -= qx
+				}
+				py += qy
+				remy -= qy
+			}
+		}
+	}
+	return baselineAverage(sum, w, h, n), true
+}
+
+// baselineResizeRGBA returns a scaled copy of the RGBA image slice r of m.
+// The returned image has width w and height h.
+func baselineResizeRGBA(m *image.RGBA, r image.Rectangle, w, h int) image.Image {
+	ww, hh := uint64(w), uint64(h)
+	dx, dy := uint64(r.Dx()), uint64(r.Dy())
+	// See comment in baselineResize.
+	n, sum := dx*dy, make([]uint64, 4*w*h)
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		pixOffset := m.PixOffset(r.Min.X, y)
+		for x := r.Min.X; x < r.Max.X; x++ {
+			// Get the source pixel.
+			r64 := uint64(m.Pix[pixOffset+0])
+			g64 := uint64(m.Pix[pixOffset+1])
+			b64 := uint64(m.Pix[pixOffset+2])
+			a64 := uint64(m.Pix[pixOffset+3])
+			pixOffset += 4
+			// Spread the source pixel over 1 or more destination rows.
+			py := uint64(y) * hh
+			for remy := hh; remy > 0; {
+				qy := dy - (py % dy)
+				if qy > remy {
+					qy = remy
+				}
+				// Spread the source pixel over 1 or more destination columns.
+				px := uint64(x) * ww
+				index := 4 * ((py/dy)*ww + (px / dx))
+				for remx := ww; remx > 0; {
+					qx := dx - (px % dx)
+					if qx > remx {
+						qx = remx
+					}
+					qxy := qx * qy
+					sum[index+0] += r64 * qxy
+					sum[index+1] += g64 * qxy
+					sum[index+2] += b64 * qxy
+					sum[index+3] += a64 * qxy
+					index += 4
+					px += qx
+					remx -= qx
+				}
+				py += qy
+				remy -= qy
+			}
+		}
+	}
+	return baselineAverage(sum, w, h, n)
+}
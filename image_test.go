@@ -0,0 +1,47 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestUnservable(t *testing.T) {
+	for _, c := range []struct {
+		err  error
+		want bool
+	}{
+		{StatusCodeError{"u", 404}, true},
+		{StatusCodeError{"u", 410}, true},
+		{StatusCodeError{"u", 500}, false},
+		{StatusCodeError{"u", 503}, false},
+		{ContentError{"u", ContentUnsupported}, true},
+		{ImageTooLargeError{100000, 100000}, true},
+		{errors.New("dial tcp: connection refused"), false},
+		{errors.New("No such overlay: logo"), false},
+		{OverlayVersionError{"logo"}, false},
+		{DecodeBusyError{100, 100}, false},
+		{nil, false},
+	} {
+		if got := unservable(c.err); got != c.want {
+			t.Errorf("unservable(%v) = %v, want %v", c.err, got, c.want)
+		}
+	}
+}
+
+func TestFit(t *testing.T) {
+	for _, c := range []struct {
+		w, h, maxW, maxH int
+		wantW, wantH     int
+	}{
+		{800, 600, 4096, 4096, 800, 600},
+		{8000, 6000, 4096, 4096, 4096, 3072},
+		{6000, 8000, 4096, 2048, 1536, 2048},
+		{1 << 40, 0, 4096, 4096, 4096, 0},
+		{0, 1 << 62, maxRequestSize, maxRequestSize, 0, maxRequestSize},
+		{100000, 1, 4096, 4096, 4096, 1},
+	} {
+		if w, h := fit(c.w, c.h, c.maxW, c.maxH); w != c.wantW || h != c.wantH {
+			t.Errorf("fit(%d, %d, %d, %d) = %d, %d, want %d, %d", c.w, c.h, c.maxW, c.maxH, w, h, c.wantW, c.wantH)
+		}
+	}
+}
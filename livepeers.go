@@ -2,8 +2,9 @@ package main
 
 import (
 	"encoding/json"
-	"log"
 	"net/http"
+	"sort"
+	"strconv"
 	"sync"
 	"time"
 )
@@ -13,71 +14,82 @@ const peerTimeout = 5 * time.Second
 type peer struct {
 	Peer     string
 	LastSeen time.Time
+	PeerInfo
 }
 
 type PeersManager struct {
+	// Scheme of the URLs of the peers pinging, http if empty.
+	Scheme string
+
 	mu    sync.Mutex
 	peers []peer
 }
 
-func (p *PeersManager) Get() (ret []string) {
+// Get returns the live peers with their weights and loads.
+func (p *PeersManager) Get() map[string]PeerInfo {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
+	ret := make(map[string]PeerInfo)
 	for i := 0; i < len(p.peers); i++ {
 		if time.Now().Sub(p.peers[i].LastSeen) < peerTimeout {
-			ret = append(ret, p.peers[i].Peer)
+			ret[p.peers[i].Peer] = p.peers[i].PeerInfo
 		}
 	}
-	return
+	return ret
 }
 
-func (p *PeersManager) Ping(pp string) {
+func (p *PeersManager) Ping(pp string, info PeerInfo) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
 	for i := 0; i < len(p.peers); i++ {
 		if p.peers[i].Peer == pp {
 			p.peers[i].LastSeen = time.Now()
+			p.peers[i].PeerInfo = info
 			return
 		}
 	}
 	p.peers = append(p.peers, peer{
 		Peer:     pp,
 		LastSeen: time.Now(),
+		PeerInfo: info,
 	})
 }
 
-func (p *PeersManager) ServeHTTP(response http.ResponseWriter, request *http.Request) {
-	if peer := request.FormValue("peer"); peer != "" {
-		p.Ping("http://" + peer)
+// Remove forgets a peer at once, when it leaves.
+func (p *PeersManager) Remove(pp string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for i := 0; i < len(p.peers); i++ {
+		if p.peers[i].Peer == pp {
+			p.peers = append(p.peers[:i], p.peers[i+1:]...)
+			return
+		}
 	}
-	json.NewEncoder(response).Encode(p.Get())
 }
 
-func (p *PeersManager) Heartbeat(url string, setpeers func(peers ...string)) {
-	for {
-		req, err := http.NewRequest("GET", url, nil)
-		if err != nil {
-			log.Println("!!! ERROR Cannot connect to master:", err)
-			time.Sleep(time.Second)
-			continue
-		}
-		req.Close = true
-		resp, err := http.DefaultClient.Do(req)
-		if err != nil {
-			log.Println("!!! ERROR Cannot connect to master:", err)
-			time.Sleep(time.Second)
-			continue
-		}
-		var livePeers []string
-		if err := json.NewDecoder(resp.Body).Decode(&livePeers); err != nil {
-			// Will this happen?
-			panic(err)
+func (p *PeersManager) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	if peer := request.FormValue("peer"); peer != "" {
+		var info PeerInfo
+		info.Weight, _ = strconv.Atoi(request.FormValue("weight"))
+		if info.Weight < 1 {
+			info.Weight = 1
 		}
-		resp.Body.Close()
-		setpeers(livePeers...)
-
-		time.Sleep(3 * time.Second)
+		info.Load, _ = strconv.Atoi(request.FormValue("load"))
+		p.Ping(peerURL(p.Scheme, peer), info)
+	}
+	live := p.Get()
+	if request.FormValue("v") == "2" {
+		json.NewEncoder(response).Encode(live)
+		return
+	}
+	// Older nodes expect the list of peers only.
+	ret := make([]string, 0, len(live))
+	for peer := range live {
+		ret = append(ret, peer)
 	}
+	sort.Strings(ret)
+	json.NewEncoder(response).Encode(ret)
 }
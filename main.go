@@ -6,9 +6,16 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"math"
 	"net/http"
 	"net/http/cookiejar"
 	_ "net/http/pprof"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"golang.org/x/net/publicsuffix"
@@ -30,18 +37,94 @@ type Config struct {
 	Image struct {
 		CacheSize   int64 `yaml:"cache_size"`
 		MaxItemSize int64 `yaml:"max_item_size"`
+		// Cache for the source images variants are derived from
+		OriginalCacheSize int64 `yaml:"original_cache_size"`
+		// Maximum size of the images served
+		MaxWidth  int `yaml:"max_width"`
+		MaxHeight int `yaml:"max_height"`
+		// Decompression bomb protection
+		MaxPixels    int64 `yaml:"max_pixels"`
+		MaxDimension int   `yaml:"max_dimension"`
+		DecodeMemory int64 `yaml:"decode_memory"`
+		// Seconds an image waits for decode_memory before failing with 503
+		DecodeTimeout int64 `yaml:"decode_timeout"`
+		// Image file served when the origin content can't be
+		Placeholder string                   `yaml:"placeholder"`
+		Presets     map[string]ImagePreset   `yaml:"presets"`
+		Overlays    map[string]OverlayConfig `yaml:"overlays"`
 	}
 	Dimension struct {
 		CacheSize int64 `yaml:"cache_size"`
 	}
+	Palette struct {
+		CacheSize int64 `yaml:"cache_size"`
+	}
+	PHash struct {
+		CacheSize int64 `yaml:"cache_size"`
+	}
+	BlurHash struct {
+		CacheSize int64 `yaml:"cache_size"`
+	}
+	Cluster ClusterConfig
+}
+
+// ClusterConfig tells how nodes find each other, overridden by the flags.
+type ClusterConfig struct {
+	// One of master (default), gossip, static or dns
+	Membership string `yaml:"membership"`
+	// Nodes to join the gossip through, as host:port
+	Seeds []string `yaml:"seeds"`
+	// All the nodes for the static membership, as host:port
+	Peers []string `yaml:"peers"`
+	// Name resolved for the dns membership, and how often, in seconds
+	DNS         string `yaml:"dns"`
+	DNSInterval int64  `yaml:"dns_interval"`
+	// Timeout of requests to peers, in seconds, 5 by default
+	PeerTimeout int64 `yaml:"peer_timeout"`
+	// Authentication of peer traffic, with a shared secret, mutual TLS or
+	// both. These are always read from the local config file.
+	SecretFile string `yaml:"secret_file" json:"-"`
+	CertFile   string `yaml:"cert_file" json:"-"`
+	KeyFile    string `yaml:"key_file" json:"-"`
+	CAFile     string `yaml:"ca_file" json:"-"`
+	// Idle connections kept to each peer
+	PeerIdleConns int `yaml:"peer_idle_conns"`
+	// Speak HTTP/2 between peers, which all nodes must enable together
+	HTTP2 bool `yaml:"http2"`
+	// Consistent hash points of a node of weight 1, and path of the peer
+	// requests, which all nodes must share
+	Replicas int    `yaml:"replicas"`
+	BasePath string `yaml:"base_path"`
+	// Weight of this node, advertised to the others by the master and
+	// gossip memberships. Always read from the local config file.
+	Weight int `yaml:"weight" json:"-"`
+	// Spill keys to the next node when the owner's load exceeds this
+	// factor of its share, e.g. 1.25, 0 to disable
+	LoadFactor float64 `yaml:"load_factor"`
+	// Send the concurrent requests to a peer in batches, which all nodes
+	// must enable together
+	Batch bool `yaml:"batch"`
 }
 
+const (
+	configInterval = 10 * time.Second
+	pingTimeout    = 2 * time.Second
+	// Peers taking longer to load a value are given up on, and the value
+	// is loaded locally.
+	defaultPeerTimeout = 5 * time.Second
+)
+
 var (
 	flagConfigFile  = flag.String("config", "ggfetch.yml", "Config file to use.")
 	flagBind        = flag.String("bind", "localhost", "Address to bind on. Special value ec2 will use the local ipv4 address and localhost instead.")
 	flagPort        = flag.Int("port", 9001, "Port to listen on.")
 	flagListenLocal = flag.Bool("listenlocal", false, "Listen to 127.0.0.1 in addition to the bind address.")
-	flagMaster      = flag.String("master", "", "Master server to get config from.")
+	flagMaster      = flag.String("master", "", "Comma separated master candidates to get config from. Empty to use the local config file.")
+	flagMembership  = flag.String("membership", "", "How nodes find each other: master, gossip, static or dns. Defaults to the config file, or master.")
+	flagSeeds       = flag.String("seeds", "", "Comma separated nodes to join the gossip through.")
+	flagPeers       = flag.String("peers", "", "Comma separated nodes of the static membership.")
+	flagWeight      = flag.Int("weight", 0, "Weight of this node in the consistent hash, defaults to the config file, or 1.")
+	flagDNS         = flag.String("dns", "", "Name to resolve the nodes from for the dns membership, either a SRV name or a host name.")
 )
 
 // http client
@@ -77,21 +160,38 @@ func main() {
 	}
 
 	me := fmt.Sprintf("%s:%d", *flagBind, *flagPort)
-	var config Config
-
-	if *flagMaster == "" {
-		bytes, err := ioutil.ReadFile(*flagConfigFile)
+	masters := splitList(*flagMaster)
+	// Nodes with a master may have a local config file for the settings
+	// specific to this node, such as the peer authentication.
+	local, err := readConfigFile()
+	if len(masters) == 0 {
 		check(err)
-		yaml.Unmarshal(bytes, &config)
-		*flagMaster = me
-	} else {
+	}
+	auth, err := NewPeerAuth(local.Cluster)
+	check(err)
+	if len(masters) > 0 {
 		log.Println("Getting config from master:", *flagMaster)
-		resp, err := http.Get(fmt.Sprintf("http://%s/config", *flagMaster))
-		check(err)
-		check(json.NewDecoder(resp.Body).Decode(&config))
-		resp.Body.Close()
 	}
+	// Over HTTP/1, which all nodes serve, as HTTP/2 is set in the config.
+	configClient := &http.Client{
+		Transport: NewPeerTransport(ClusterConfig{}, auth),
+		Timeout:   pingTimeout,
+	}
+	config, err := loadConfig(configClient, auth.Scheme(), masters)
+	check(err)
 	log.Printf("Config loaded: %#v", config)
+	cluster := clusterConfig(config, local, masters)
+	peerTransport := NewPeerTransport(cluster, auth)
+	election := &Election{
+		Self:   me,
+		Seeds:  masters,
+		Client: &http.Client{Transport: peerTransport, Timeout: pingTimeout},
+		Peers:  &PeersManager{Scheme: auth.Scheme()},
+		Scheme: auth.Scheme(),
+		Weight: cluster.Weight,
+	}
+	var currentConfig atomic.Value
+	currentConfig.Store(config)
 
 	// Setup GGFetch
 	defaultHTTPClient := getHTTPClient(&config)
@@ -100,38 +200,143 @@ func main() {
 		MaxItemSize: config.HTML.MaxItemSize << 10,
 		Client:      defaultHTTPClient,
 	}, config.HTML.CacheSize<<20)
-	ggfetch.Register("image", ImageFetcher{
+	limits := DecodeLimits{
+		MaxPixels:    config.Image.MaxPixels,
+		MaxDimension: config.Image.MaxDimension,
+	}
+	if config.Image.DecodeMemory > 0 {
+		limits.Budget = NewMemoryBudget(config.Image.DecodeMemory << 20)
+		limits.BudgetTimeout = time.Duration(config.Image.DecodeTimeout) * time.Second
+	}
+	var placeholder []byte
+	if config.Image.Placeholder != "" {
+		content, err := ioutil.ReadFile(config.Image.Placeholder)
+		check(err)
+		placeholder = content
+	}
+	overlays := new(Overlays)
+	check(overlays.Load(config.Image.Overlays))
+	presets := make(map[string]ImagePreset)
+	for name, preset := range config.Image.Presets {
+		if preset.Placeholder != "" {
+			content, err := ioutil.ReadFile(preset.Placeholder)
+			check(err)
+			preset.placeholder = content
+		}
+		presets[name] = preset
+	}
+	ggfetch.RegisterInternal(originalGroup, OriginalFetcher{
 		MaxItemSize: config.Image.MaxItemSize << 10,
 		Client:      defaultHTTPClient,
+	}, config.Image.OriginalCacheSize<<20)
+	ggfetch.Register("image", ImageFetcher{
+		MaxWidth:    config.Image.MaxWidth,
+		MaxHeight:   config.Image.MaxHeight,
+		Limits:      limits,
+		Presets:     presets,
+		Overlays:    overlays,
+		Placeholder: placeholder,
 	}, config.Image.CacheSize<<20)
 	ggfetch.Register("dimension", DimensionFetcher{
 		Client: defaultHTTPClient,
 	}, config.Dimension.CacheSize<<20)
+	ggfetch.Register("palette", PaletteFetcher{}, config.Palette.CacheSize<<20)
+	ggfetch.Register("phash", PHashFetcher{}, config.PHash.CacheSize<<20)
+	ggfetch.Register("blurhash", BlurHashFetcher{}, config.BlurHash.CacheSize<<20)
 
 	// Fetchers
 	http.Handle("/", ggfetch)
 
-	http.HandleFunc("/config", func(response http.ResponseWriter, request *http.Request) {
-		json.NewEncoder(response).Encode(config)
+	http.Handle("/config", auth.Protect(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		json.NewEncoder(response).Encode(currentConfig.Load())
+	})))
+	go watchConfig(configClient, auth.Scheme(), func() []string {
+		if len(election.Seeds) == 0 {
+			return nil
+		}
+		return []string{election.Master()}
+	}, config, func(c Config) {
+		log.Println("Config changed, reloading overlays")
+		if err := overlays.Load(c.Image.Overlays); err != nil {
+			log.Println("!!! ERROR Cannot reload overlays:", err)
+		}
+		currentConfig.Store(c)
 	})
 
+	peers := NewPeersPoolOpts(peerURL(auth.Scheme(), me), &PeersPoolOptions{
+		BasePath: cluster.BasePath,
+		Replicas: cluster.Replicas,
+	})
+	if cluster.LoadFactor > 0 {
+		peers.LoadFactor = math.Max(cluster.LoadFactor, 1)
+	}
+	peers.Batch = cluster.Batch
+	peers.Transport = func(groupcache.Context) http.RoundTripper {
+		return peerTransport
+	}
+	if auth.Enabled() {
+		peers.Verify = auth.Verify
+	}
+	peers.Timeout = time.Duration(cluster.PeerTimeout) * time.Second
+	if peers.Timeout <= 0 {
+		peers.Timeout = defaultPeerTimeout
+	}
 	http.HandleFunc("/stats", func(response http.ResponseWriter, request *http.Request) {
 		var stats struct {
 			Caches map[string]groupcache.CacheStats
+			Peers  map[string]PeerStats
 		}
 		stats.Caches = make(map[string]groupcache.CacheStats)
 		for name, handler := range ggfetch.methods {
 			stats.Caches[name] = handler.Group.CacheStats(groupcache.MainCache)
 			stats.Caches[name+"_hot"] = handler.Group.CacheStats(groupcache.HotCache)
 		}
+		stats.Peers = peers.Stats()
 		json.NewEncoder(response).Encode(stats)
 	})
+	http.HandleFunc("/ring", func(response http.ResponseWriter, request *http.Request) {
+		json.NewEncoder(response).Encode(peers.Ring(request.FormValue("key")))
+	})
 
 	// Peers
-	peers := NewPeersPool("http://" + me)
-	peersManager := new(PeersManager)
-	http.Handle("/ping", peersManager)
-	go peersManager.Heartbeat(fmt.Sprintf("http://%s/ping?peer=%s", *flagMaster, me), peers.Set)
+	drainer := &Drainer{
+		Self:   me,
+		Peers:  peers,
+		Scheme: auth.Scheme(),
+		Client: &http.Client{Transport: peerTransport, Timeout: pingTimeout},
+	}
+	switch cluster.Membership {
+	case "master":
+		drainer.Leave = election.Leave
+		election.Load = peers.Load
+		http.Handle("/ping", auth.Protect(election))
+		go election.Heartbeat(peers.Update)
+	case "gossip":
+		gossip := &Gossip{
+			Self:   me,
+			Seeds:  cluster.Seeds,
+			Client: &http.Client{Transport: peerTransport, Timeout: probeTimeout},
+			Scheme: auth.Scheme(),
+			Weight: cluster.Weight,
+			Load:   peers.Load,
+		}
+		drainer.Leave = gossip.Leave
+		http.Handle("/gossip", auth.Protect(gossip))
+		go gossip.Run(peers.Update)
+	case "static":
+		peers.Set(peerURLs(auth.Scheme(), me, cluster.Peers)...)
+	case "dns":
+		dns := &DNSDiscovery{
+			Self:     me,
+			Name:     cluster.DNS,
+			Port:     *flagPort,
+			Scheme:   auth.Scheme(),
+			Interval: time.Duration(cluster.DNSInterval) * time.Second,
+		}
+		go dns.Run(peers.Set)
+	}
+	http.Handle("/drain", localOnly(drainer))
+	http.Handle("/leave", auth.Protect(http.HandlerFunc(drainer.ServeLeave)))
 
 	var servers []*http.Server
 	servers = append(servers, &http.Server{
@@ -139,19 +344,146 @@ func main() {
 		Handler:      nil,
 		ReadTimeout:  10 * time.Second,
 		WriteTimeout: 60 * time.Second,
+		IdleTimeout:  peerIdleTimeout,
+		TLSConfig:    auth.TLSConfig(),
 	})
+	check(configurePeerServer(servers[0], cluster))
 	if *flagListenLocal {
 		servers = append(servers, &http.Server{
 			Addr:         fmt.Sprintf("localhost:%d", *flagPort),
 			Handler:      nil,
 			ReadTimeout:  10 * time.Second,
 			WriteTimeout: 60 * time.Second,
+			IdleTimeout:  peerIdleTimeout,
 		})
 	}
-	for _, server := range servers {
-		server.SetKeepAlivesEnabled(false)
-	}
+
+	// gracehttp stops on these signals too, closing the listeners at once,
+	// so leaving here is only a last resort: /drain should be requested
+	// before stopping.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	leaving := make(chan struct{})
+	drained := make(chan struct{})
+	go func() {
+		<-signals
+		close(leaving)
+		drainer.Drain()
+		close(drained)
+	}()
 	check(gracehttp.Serve(servers...))
+	select {
+	case <-leaving:
+		<-drained
+	default:
+		// Restarting, the new process takes over.
+	}
+}
+
+// clusterConfig applies the flags over the cluster section of the config.
+// Nodes with a master always use the master membership, whatever the
+// master's config says.
+func clusterConfig(config, local Config, masters []string) ClusterConfig {
+	cluster := config.Cluster
+	if len(masters) > 0 {
+		cluster.Membership = "master"
+	}
+	cluster.Weight = local.Cluster.Weight
+	if *flagWeight > 0 {
+		cluster.Weight = *flagWeight
+	}
+	if cluster.Weight < 1 {
+		cluster.Weight = 1
+	}
+	if *flagMembership != "" {
+		cluster.Membership = *flagMembership
+	}
+	if seeds := splitList(*flagSeeds); len(seeds) > 0 {
+		cluster.Seeds = seeds
+	}
+	if peers := splitList(*flagPeers); len(peers) > 0 {
+		cluster.Peers = peers
+	}
+	if *flagDNS != "" {
+		cluster.DNS = *flagDNS
+	}
+	switch cluster.Membership {
+	case "":
+		cluster.Membership = "master"
+	case "master":
+	case "gossip", "static", "dns":
+		if len(masters) > 0 {
+			log.Fatalln("-master is only used with the master membership")
+		}
+	default:
+		log.Fatalln("Unknown membership:", cluster.Membership)
+	}
+	if cluster.Membership == "dns" && cluster.DNS == "" {
+		log.Fatalln("No name to resolve for the dns membership")
+	}
+	return cluster
+}
+
+func readConfigFile() (config Config, err error) {
+	bytes, err := ioutil.ReadFile(*flagConfigFile)
+	if err != nil {
+		return config, err
+	}
+	err = yaml.Unmarshal(bytes, &config)
+	return config, err
+}
+
+// loadConfig reads the config file if masters is empty, or gets the config
+// from the first of masters that answers, with scheme.
+func loadConfig(client *http.Client, scheme string, masters []string) (config Config, err error) {
+	if len(masters) == 0 {
+		return readConfigFile()
+	}
+	for _, master := range masters {
+		var resp *http.Response
+		u := peerURL(scheme, master) + "/config"
+		resp, err = client.Get(u)
+		if err != nil {
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			err = StatusCodeError{u, resp.StatusCode}
+			continue
+		}
+		err = json.NewDecoder(resp.Body).Decode(&config)
+		resp.Body.Close()
+		if err == nil {
+			return
+		}
+	}
+	return
+}
+
+// watchConfig polls the config and calls changed whenever it differs from last.
+// Only overlays are reloaded, other changes take effect on restart.
+func watchConfig(client *http.Client, scheme string, masters func() []string, last Config, changed func(Config)) {
+	for range time.Tick(configInterval) {
+		config, err := loadConfig(client, scheme, masters())
+		if err != nil {
+			log.Println("!!! ERROR Cannot reload config:", err)
+			continue
+		}
+		if !reflect.DeepEqual(config, last) {
+			changed(config)
+			last = config
+		}
+	}
+}
+
+// splitList splits a comma separated list, ignoring empty items.
+func splitList(s string) (ret []string) {
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			ret = append(ret, item)
+		}
+	}
+	return
 }
 
 func check(err error) {
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"io/ioutil"
+	"net/http"
+	"sync"
+)
+
+// OverlayConfig describes an image stamped onto resized images, e.g. a logo.
+type OverlayConfig struct {
+	// PNG file of the overlay.
+	File string `yaml:"file"`
+	// One of top-left, top, top-right, left, center, right, bottom-left,
+	// bottom and bottom-right (default).
+	Position string `yaml:"position"`
+	// Distance from the edges, in output pixels.
+	Margin int `yaml:"margin"`
+	// From 0 to 1, default 1.
+	Opacity float64 `yaml:"opacity"`
+	// Width of the overlay relative to the output width, 0 to keep its size.
+	Scale float64 `yaml:"scale"`
+}
+
+type overlay struct {
+	OverlayConfig
+	image image.Image
+	// Hash of the file and config, the same on all nodes loading them.
+	version string
+}
+
+// OverlayVersionError is returned when an image was requested for another
+// version of the overlay than the one loaded, while the nodes reload it.
+type OverlayVersionError struct {
+	Name string
+}
+
+func (e OverlayVersionError) Error() string {
+	return fmt.Sprintf("Overlay %s is being reloaded", e.Name)
+}
+
+func (e OverlayVersionError) StatusCode() int {
+	return http.StatusServiceUnavailable
+}
+
+// Overlays holds the overlays loaded from the config by name.
+type Overlays struct {
+	mu       sync.RWMutex
+	overlays map[string]*overlay
+}
+
+// Load decodes the overlay files and replaces all overlays at once.
+// The old overlays are kept if any file fails to load.
+func (o *Overlays) Load(configs map[string]OverlayConfig) error {
+	overlays := make(map[string]*overlay)
+	for name, c := range configs {
+		b, err := ioutil.ReadFile(c.File)
+		if err != nil {
+			return err
+		}
+		m, _, err := image.Decode(bytes.NewReader(b))
+		if err != nil {
+			return fmt.Errorf("overlay %s: %v", name, err)
+		}
+		if c.Opacity <= 0 || c.Opacity > 1 {
+			c.Opacity = 1
+		}
+		h := sha256.New()
+		h.Write(b)
+		fmt.Fprintf(h, "%+v", c)
+		overlays[name] = &overlay{c, m, hex.EncodeToString(h.Sum(nil)[:8])}
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.overlays = overlays
+	return nil
+}
+
+func (o *Overlays) Get(name string) *overlay {
+	if o == nil {
+		return nil
+	}
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	return o.overlays[name]
+}
+
+// Draw returns a copy of m with the overlay composited onto it.
+func (o *overlay) Draw(m image.Image) image.Image {
+	b := m.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Bounds(), m, b.Min, draw.Src)
+
+	src := o.image
+	sb := src.Bounds()
+	if o.Scale > 0 {
+		w := int(o.Scale * float64(b.Dx()))
+		h := sb.Dy() * w / sb.Dx()
+		if w < 1 || h < 1 {
+			return dst
+		}
+		src = ResizeFilter(src, sb, w, h, CatmullRomFilter, false)
+		sb = src.Bounds()
+	}
+
+	var x, y int
+	switch o.Position {
+	case "top-left", "left", "bottom-left":
+		x = o.Margin
+	case "top", "center", "bottom":
+		x = (b.Dx() - sb.Dx()) / 2
+	default:
+		x = b.Dx() - sb.Dx() - o.Margin
+	}
+	switch o.Position {
+	case "top-left", "top", "top-right":
+		y = o.Margin
+	case "left", "center", "right":
+		y = (b.Dy() - sb.Dy()) / 2
+	default:
+		y = b.Dy() - sb.Dy() - o.Margin
+	}
+	r := image.Rectangle{image.Pt(x, y), image.Pt(x, y).Add(sb.Size())}
+	mask := image.NewUniform(color.Alpha{uint8(o.Opacity*0xff + 0.5)})
+	draw.DrawMask(dst, r, src, sb.Min, mask, image.Point{}, draw.Over)
+	return dst
+}
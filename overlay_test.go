@@ -0,0 +1,73 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/png"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeOverlay(t *testing.T, file string, c color.Color) {
+	m := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	m.Set(0, 0, c)
+	f, err := os.Create(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := png.Encode(f, m); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOverlayVersion(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "logo.png")
+	writeOverlay(t, file, color.White)
+	overlays := new(Overlays)
+	configs := map[string]OverlayConfig{"logo": {File: file}}
+	if err := overlays.Load(configs); err != nil {
+		t.Fatal(err)
+	}
+	i := ImageFetcher{
+		Overlays: overlays,
+		Presets:  map[string]ImagePreset{"thumb": {Width: 100, Overlay: "logo"}},
+	}
+	q := url.Values{"url": {"u"}, "overlay": {"logo"}}
+	v1 := i.Version(q)
+	if v1 == "" {
+		t.Fatal("no version for an overlay")
+	}
+	if got := i.Version(url.Values{"url": {"u"}, "preset": {"thumb"}}); got != v1 {
+		t.Errorf("version of the preset's overlay %q, want %q", got, v1)
+	}
+	if got := i.Version(url.Values{"url": {"u"}}); got != "" {
+		t.Errorf("version %q without an overlay", got)
+	}
+
+	// The same file loaded again, e.g. by another node, has the same version.
+	if err := overlays.Load(configs); err != nil {
+		t.Fatal(err)
+	}
+	if got := i.Version(q); got != v1 {
+		t.Errorf("version changed to %q on reloading the same file", got)
+	}
+
+	writeOverlay(t, file, color.Black)
+	if err := overlays.Load(configs); err != nil {
+		t.Fatal(err)
+	}
+	if got := i.Version(q); got == v1 {
+		t.Error("version unchanged after the file changed")
+	}
+	configs["logo"] = OverlayConfig{File: file, Position: "top-left"}
+	v2 := i.Version(q)
+	if err := overlays.Load(configs); err != nil {
+		t.Fatal(err)
+	}
+	if got := i.Version(q); got == v2 {
+		t.Error("version unchanged after the config changed")
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image/color"
+	"net/url"
+	"sort"
+	"strconv"
+)
+
+const (
+	// Width of the /image variant palettes are computed from.
+	paletteSourceWidth = 128
+	// The image is then scaled down to fit in a square this large.
+	paletteSampleSize    = 64
+	defaultPaletteColors = 5
+	maxPaletteColors     = 16
+	// k-means rounds refining the median cut.
+	paletteRounds = 4
+)
+
+type palette struct {
+	Dominant    string
+	Palette     []paletteColor
+	Luminance   float64
+	Transparent bool
+}
+
+type paletteColor struct {
+	Color string
+	// Share of the opaque pixels closest to this colour.
+	Weight float64
+}
+
+type PaletteFetcher struct {
+	DumpContentResponse
+}
+
+func (p PaletteFetcher) Generate(query url.Values) (content []byte, err error) {
+	u := query.Get("url")
+	n, _ := strconv.Atoi(query.Get("colors"))
+	if n <= 0 {
+		n = defaultPaletteColors
+	}
+	if n > maxPaletteColors {
+		n = maxPaletteColors
+	}
+	m, err := cachedImage(u, paletteSourceWidth)
+	if err != nil {
+		return nil, err
+	}
+	w, h := fitIn(m.Bounds().Dx(), m.Bounds().Dy(), paletteSampleSize)
+	m = Resize(m, m.Bounds(), w, h)
+
+	var ret palette
+	var pixels []color.RGBA
+	var luminance, opacity float64
+	b := m.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.NRGBAModel.Convert(m.At(x, y)).(color.NRGBA)
+			// Weighted by alpha, as transparent pixels don't show.
+			alpha := float64(c.A) / 255
+			luminance += alpha * (0.2126*float64(c.R) + 0.7152*float64(c.G) + 0.0722*float64(c.B)) / 255
+			opacity += alpha
+			if c.A < 0xff {
+				ret.Transparent = true
+			}
+			// Mostly transparent pixels don't show, leave them out of the palette.
+			if c.A >= 0x80 {
+				pixels = append(pixels, color.RGBA{c.R, c.G, c.B, 0xff})
+			}
+		}
+	}
+	if opacity > 0 {
+		ret.Luminance = luminance / opacity
+	}
+	ret.Palette = medianCut(pixels, n)
+	if len(ret.Palette) > 0 {
+		ret.Dominant = ret.Palette[0].Color
+	}
+	return json.Marshal(ret)
+}
+
+// fitIn scales w*h down to fit in a size*size square, keeping the aspect ratio.
+func fitIn(w, h, size int) (int, int) {
+	switch {
+	case w <= size && h <= size:
+		return w, h
+	case w >= h:
+		return size, max1(h * size / w)
+	default:
+		return max1(w * size / h), size
+	}
+}
+
+func max1(v int) int {
+	if v < 1 {
+		return 1
+	}
+	return v
+}
+
+// medianCut quantizes pixels to at most n colours, most common first.
+// The box with the widest channel range is repeatedly split at its median
+// along that channel.
+func medianCut(pixels []color.RGBA, n int) []paletteColor {
+	if len(pixels) == 0 {
+		return nil
+	}
+	boxes := [][]color.RGBA{pixels}
+	for len(boxes) < n {
+		best, bestRange, bestChannel := -1, 0, 0
+		for i, box := range boxes {
+			if len(box) < 2 {
+				continue
+			}
+			if channel, r := widestChannel(box); r > bestRange {
+				best, bestRange, bestChannel = i, r, channel
+			}
+		}
+		if best < 0 {
+			break
+		}
+		box := boxes[best]
+		sort.Slice(box, func(i, j int) bool {
+			return channelOf(box[i], bestChannel) < channelOf(box[j], bestChannel)
+		})
+		boxes[best] = box[:len(box)/2]
+		boxes = append(boxes, box[len(box)/2:])
+	}
+
+	// Median cut splits by count, so a box may straddle two clusters.
+	// A few k-means rounds seeded with the box averages settle that.
+	centers := make([][3]int, len(boxes))
+	for i, box := range boxes {
+		centers[i] = boxAverage(box)
+	}
+	counts := make([]int, len(centers))
+	for round := 0; round < paletteRounds; round++ {
+		sums := make([][3]int, len(centers))
+		for i := range counts {
+			counts[i] = 0
+		}
+		for _, c := range pixels {
+			k := nearest(centers, c)
+			sums[k][0] += int(c.R)
+			sums[k][1] += int(c.G)
+			sums[k][2] += int(c.B)
+			counts[k]++
+		}
+		for k := range centers {
+			if counts[k] > 0 {
+				centers[k] = [3]int{sums[k][0] / counts[k], sums[k][1] / counts[k], sums[k][2] / counts[k]}
+			}
+		}
+	}
+
+	var ret []paletteColor
+	for k, c := range centers {
+		if counts[k] == 0 {
+			continue
+		}
+		ret = append(ret, paletteColor{
+			Color:  fmt.Sprintf("#%02x%02x%02x", c[0], c[1], c[2]),
+			Weight: float64(counts[k]) / float64(len(pixels)),
+		})
+	}
+	sort.SliceStable(ret, func(i, j int) bool { return ret[i].Weight > ret[j].Weight })
+	return ret
+}
+
+func boxAverage(box []color.RGBA) [3]int {
+	var sum [3]int
+	for _, c := range box {
+		sum[0] += int(c.R)
+		sum[1] += int(c.G)
+		sum[2] += int(c.B)
+	}
+	return [3]int{sum[0] / len(box), sum[1] / len(box), sum[2] / len(box)}
+}
+
+func nearest(centers [][3]int, c color.RGBA) int {
+	best, bestDist := 0, -1
+	for k, center := range centers {
+		dr, dg, db := center[0]-int(c.R), center[1]-int(c.G), center[2]-int(c.B)
+		if d := dr*dr + dg*dg + db*db; bestDist < 0 || d < bestDist {
+			best, bestDist = k, d
+		}
+	}
+	return best
+}
+
+func widestChannel(box []color.RGBA) (channel, width int) {
+	for ch := 0; ch < 3; ch++ {
+		lo, hi := 0xff, 0
+		for _, c := range box {
+			v := channelOf(c, ch)
+			if v < lo {
+				lo = v
+			}
+			if v > hi {
+				hi = v
+			}
+		}
+		if hi-lo > width {
+			channel, width = ch, hi-lo
+		}
+	}
+	return
+}
+
+func channelOf(c color.RGBA, ch int) int {
+	switch ch {
+	case 0:
+		return int(c.R)
+	case 1:
+		return int(c.G)
+	}
+	return int(c.B)
+}
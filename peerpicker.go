@@ -24,22 +24,71 @@ package main
 import (
 	"fmt"
 	"io/ioutil"
+	"math"
+	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
+	"reflect"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/golang/protobuf/proto"
 	. "github.com/golang/groupcache"
-	"github.com/golang/groupcache/consistenthash"
 	pb "github.com/golang/groupcache/groupcachepb"
 )
 
-// TODO: make this configurable?
 const defaultBasePath = "/_groupcache/"
 
-// TODO: make this configurable as well.
-const defaultReplicas = 3
+const defaultReplicas = 50
+
+// How long a peer that left is kept out, even if the membership still lists it.
+const leaveTimeout = 10 * time.Second
+
+const (
+	// Consecutive failures after which a peer is skipped.
+	breakerFailures = 3
+	// How long a failing peer is skipped before it's tried again.
+	breakerTimeout = 10 * time.Second
+)
+
+// PeerStats counts the requests to a peer. Failed and skipped requests are
+// loaded locally instead.
+type PeerStats struct {
+	Gets   int64
+	Errors int64
+	// Requests not sent as the peer was failing.
+	Skipped int64
+	// Requests for keys owned by the peer sent to the next node instead, as
+	// the peer was loaded.
+	Spilled int64
+	// The peer is failing, and is being skipped.
+	Open bool
+}
+
+type peerHealth struct {
+	PeerStats
+	// Consecutive failures of the peer itself, as opposed to errors
+	// fetching the values.
+	failures  int
+	openUntil time.Time
+	// Requests to the peer in flight.
+	inflight int
+}
+
+type groupKey struct {
+	group, key string
+}
+
+// PeerInfo is what the membership tells about a peer.
+type PeerInfo struct {
+	Weight int
+	// Requests the peer is serving to its peers.
+	Load int
+}
 
 // PeersPool implements PeerPicker for a pool of HTTP peers.
 type PeersPool struct {
@@ -53,14 +102,65 @@ type PeersPool struct {
 	// If nil, the client uses http.DefaultTransport.
 	Transport func(Context) http.RoundTripper
 
+	// Timeout optionally limits the time of each request to a peer.
+	Timeout time.Duration
+
+	// Verify optionally checks that a request comes from a peer.
+	Verify func(*http.Request) error
+
+	// LoadFactor optionally bounds the load of the peers: a key is sent
+	// to the next peer on the consistent hash when its owner's load would
+	// exceed LoadFactor times its share of the total load, e.g. 1.25.
+	LoadFactor float64
+
+	// Batch optionally sends the concurrent requests to a peer together, in
+	// batches. All peers must serve batches.
+	Batch bool
+
 	// base path including leading and trailing slash, e.g. "/_groupcache/"
 	basePath string
 
+	// points of a peer of weight 1 on the ring
+	replicas int
+
 	// this peer's base URL, e.g. "https://example.net:8000"
 	self string
 
 	mu    sync.Mutex
-	peers *consistenthash.Map
+	peers *Ring
+	// The peers as last set with their weights and loads, and the peers
+	// that left.
+	weights map[string]int
+	loads   map[string]int
+	left    map[string]time.Time
+	health  map[string]*peerHealth
+	// The batchers of the peers, when batching.
+	batchers map[string]*batcher
+	// The peers in the ring, and their total weight.
+	active      map[string]int
+	totalWeight int
+
+	// Requests from peers in flight, and their keys, which are always
+	// loaded by this peer, so that the requests don't bounce. Groups share
+	// keys, so these are per group.
+	load    int
+	serving map[groupKey]int
+
+	// Set when draining, requests from peers are then refused.
+	draining bool
+	inflight sync.WaitGroup
+}
+
+// PeersPoolOptions are the configurations of a PeersPool, which all peers
+// must share.
+type PeersPoolOptions struct {
+	// BasePath specifies the HTTP path that will serve groupcache requests.
+	// If blank, it defaults to "/_groupcache/".
+	BasePath string
+
+	// Replicas specifies the number of points of a peer of weight 1 on the
+	// consistent hash. If blank, it defaults to 50.
+	Replicas int
 }
 
 var httpPoolMade bool
@@ -71,38 +171,330 @@ var httpPoolMade bool
 // The self argument be a valid base URL that points to the current server,
 // for example "http://example.net:8000".
 func NewPeersPool(self string) *PeersPool {
+	return NewPeersPoolOpts(self, nil)
+}
+
+// NewPeersPoolOpts initializes an HTTP pool of peers with the given options.
+// Like NewPeersPool, it registers itself as a PeerPicker and as an HTTP
+// handler with the http.DefaultServeMux, under the configured base path.
+func NewPeersPoolOpts(self string, o *PeersPoolOptions) *PeersPool {
 	if httpPoolMade {
 		panic("groupcache: NewPeersPool must be called only once")
 	}
 	httpPoolMade = true
-	p := &PeersPool{basePath: defaultBasePath, self: self, peers: consistenthash.New(defaultReplicas, nil)}
-	RegisterPeerPicker(func() PeerPicker { return p })
-	http.Handle(defaultBasePath, p)
+	p := &PeersPool{basePath: defaultBasePath, replicas: defaultReplicas, self: self}
+	if o != nil {
+		if o.BasePath != "" {
+			p.basePath = o.BasePath
+		}
+		if o.Replicas > 0 {
+			p.replicas = o.Replicas
+		}
+	}
+	p.peers = NewRing(p.replicas)
+	RegisterPerGroupPeerPicker(func(group string) PeerPicker { return groupPicker{p, group} })
+	http.Handle(p.basePath, p)
 	return p
 }
 
-// Set updates the pool's list of peers.
+// Set updates the pool's list of peers, all of weight 1.
 // Each peer value should be a valid base URL,
 // for example "http://example.net:8000".
 func (p *PeersPool) Set(peers ...string) {
+	weights := make(map[string]int)
+	for _, peer := range peers {
+		weights[peer] = 1
+	}
+	p.SetWeighted(weights)
+}
+
+// SetWeighted updates the pool's peers with their weights, a peer of weight
+// 2 owning about twice the keys of a peer of weight 1.
+func (p *PeersPool) SetWeighted(peers map[string]int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.weights = peers
+	p.rebuild()
+}
+
+// Update updates the pool's peers with their weights and loads, as told by
+// the membership.
+func (p *PeersPool) Update(peers map[string]PeerInfo) {
+	weights := make(map[string]int)
+	loads := make(map[string]int)
+	for peer, info := range peers {
+		weights[peer] = info.Weight
+		loads[peer] = info.Load
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.loads = loads
+	if !reflect.DeepEqual(weights, p.weights) {
+		p.weights = weights
+		p.rebuild()
+		return
+	}
+	p.readmit()
+}
+
+// Load returns the number of requests from peers in flight.
+func (p *PeersPool) Load() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.load
+}
+
+// Remove takes a peer out at once, when it leaves.
+func (p *PeersPool) Remove(peer string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.left == nil {
+		p.left = make(map[string]time.Time)
+	}
+	p.left[peer] = time.Now()
+	p.rebuild()
+}
+
+// readmit rebuilds the ring once a peer that left may come back, as the
+// membership may not change meanwhile.
+func (p *PeersPool) readmit() {
+	for _, t := range p.left {
+		if time.Since(t) >= leaveTimeout {
+			p.rebuild()
+			return
+		}
+	}
+}
+
+func (p *PeersPool) rebuild() {
+	if p.replicas <= 0 {
+		p.replicas = defaultReplicas
+	}
+	for peer, t := range p.left {
+		if time.Since(t) >= leaveTimeout {
+			delete(p.left, peer)
+		}
+	}
+	p.peers = NewRing(p.replicas)
+	p.active = make(map[string]int)
+	p.totalWeight = 0
+	for peer, weight := range p.weights {
+		if _, ok := p.left[peer]; ok {
+			continue
+		}
+		if weight < 1 {
+			weight = 1
+		}
+		p.peers.Add(peer, weight)
+		p.active[peer] = weight
+		p.totalWeight += weight
+	}
+}
+
+// Peers returns the peers as last set.
+func (p *PeersPool) Peers() (ret []string) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
-	p.peers = consistenthash.New(defaultReplicas, nil)
-	p.peers.Add(peers...)
+	for peer := range p.weights {
+		ret = append(ret, peer)
+	}
+	sort.Strings(ret)
+	return
 }
 
+// RingPeer describes the part of a peer in the consistent hash.
+type RingPeer struct {
+	Weight int
+	// Part of the key space owned, from 0 to 1.
+	Share float64
+}
+
+// RingInfo describes the consistent hash, for debugging.
+type RingInfo struct {
+	BasePath string
+	Replicas int
+	Peers    map[string]RingPeer
+	// The owner of the key asked for, if any.
+	Owner string `json:",omitempty"`
+}
+
+// Ring describes the consistent hash, and the owner of key if not empty.
+func (p *PeersPool) Ring(key string) RingInfo {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	info := RingInfo{BasePath: p.basePath, Replicas: p.replicas, Peers: make(map[string]RingPeer)}
+	for peer, share := range p.peers.Shares() {
+		info.Peers[peer] = RingPeer{p.weights[peer], share}
+	}
+	if key != "" {
+		info.Owner = p.peers.Get(key)
+	}
+	return info
+}
+
+// Drain refuses the requests from peers from now on, so that they load the
+// values themselves.
+func (p *PeersPool) Drain() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.draining = true
+}
+
+// Wait waits for the requests from peers in flight. Only call it after Drain.
+func (p *PeersPool) Wait() {
+	p.inflight.Wait()
+}
+
+// groupPicker picks the peers of the keys of a group.
+type groupPicker struct {
+	*PeersPool
+	group string
+}
+
+func (g groupPicker) PickPeer(key string) (ProtoGetter, bool) {
+	return g.pick(g.group, key)
+}
+
+// PickPeer picks the peer of a key, not knowing its group.
 func (p *PeersPool) PickPeer(key string) (ProtoGetter, bool) {
+	return p.pick("", key)
+}
+
+func (p *PeersPool) pick(group, key string) (ProtoGetter, bool) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
+	p.readmit()
 	if p.peers.IsEmpty() {
 		return nil, false
 	}
-	if peer := p.peers.Get(key); peer != p.self {
-		// TODO: pre-build a slice of *httpGetter when Set()
-		// is called to avoid these two allocations.
-		return &httpGetter{p.Transport, peer + p.basePath}, true
+	if p.serving[groupKey{group, key}] > 0 {
+		return nil, false
+	}
+	peer := p.peers.Get(key)
+	if p.LoadFactor > 0 {
+		if bounded := p.bounded(key); bounded != peer {
+			// Only peers have stats, not this node.
+			if peer != p.self {
+				p.healthOf(peer).Spilled++
+			}
+			peer = bounded
+		}
+	}
+	if peer == p.self {
+		return nil, false
+	}
+	h := p.healthOf(peer)
+	if h.failures >= breakerFailures {
+		if time.Now().Before(h.openUntil) {
+			h.Skipped++
+			return nil, false
+		}
+		// Let this one through to see if the peer is back.
+		h.openUntil = time.Now().Add(breakerTimeout)
+	}
+	h.Gets++
+	h.inflight++
+	// TODO: pre-build a slice of *httpGetter when Set()
+	// is called to avoid these two allocations.
+	return &httpGetter{p.Transport, peer + p.basePath, p.Timeout, p, peer, p.batcherOf(peer)}, true
+}
+
+// batcherOf returns the batcher of peer, or nil if not batching.
+func (p *PeersPool) batcherOf(peer string) *batcher {
+	if !p.Batch {
+		return nil
+	}
+	if p.batchers == nil {
+		p.batchers = make(map[string]*batcher)
+	}
+	b := p.batchers[peer]
+	if b == nil {
+		b = &batcher{transport: p.Transport, url: peer + p.basePath, timeout: p.Timeout}
+		p.batchers[peer] = b
 	}
-	return nil, false
+	return b
+}
+
+func (p *PeersPool) healthOf(peer string) *peerHealth {
+	if p.health == nil {
+		p.health = make(map[string]*peerHealth)
+	}
+	h := p.health[peer]
+	if h == nil {
+		h = new(peerHealth)
+		p.health[peer] = h
+	}
+	return h
+}
+
+// loadOf estimates the load of peer, from what it last told and the
+// requests this peer sent it since.
+func (p *PeersPool) loadOf(peer string) int {
+	if peer == p.self {
+		return p.load
+	}
+	load := p.loads[peer]
+	if h := p.health[peer]; h != nil {
+		load += h.inflight
+	}
+	return load
+}
+
+// bounded returns the first peer on the consistent hash from key with a
+// load below its capacity, i.e. LoadFactor times its share of the total.
+// As LoadFactor is above 1, some peer always is.
+func (p *PeersPool) bounded(key string) string {
+	total := 0
+	for peer := range p.active {
+		total += p.loadOf(peer)
+	}
+	var ret string
+	p.peers.Walk(key, func(peer string) bool {
+		capacity := math.Ceil(p.LoadFactor * float64((total+1)*p.active[peer]) / float64(p.totalWeight))
+		if float64(p.loadOf(peer)+1) <= capacity {
+			ret = peer
+			return false
+		}
+		return true
+	})
+	if ret == "" {
+		return p.peers.Get(key)
+	}
+	return ret
+}
+
+// report records the outcome of a request to peer.
+func (p *PeersPool) report(peer string, err error, peerFailed bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	h := p.health[peer]
+	if h == nil {
+		return
+	}
+	h.inflight--
+	if err != nil {
+		h.Errors++
+	}
+	if !peerFailed {
+		h.failures = 0
+		return
+	}
+	if h.failures++; h.failures >= breakerFailures {
+		h.openUntil = time.Now().Add(breakerTimeout)
+	}
+}
+
+// Stats returns the stats of the peers requested so far.
+func (p *PeersPool) Stats() map[string]PeerStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ret := make(map[string]PeerStats)
+	for peer, h := range p.health {
+		stats := h.PeerStats
+		stats.Open = h.failures >= breakerFailures
+		ret[peer] = stats
+	}
+	return ret
 }
 
 func (p *PeersPool) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -110,44 +502,113 @@ func (p *PeersPool) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		panic("PeersPool serving unexpected path: " + r.URL.Path)
 	}
 
+	if p.Verify != nil {
+		if err := p.Verify(r); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+	}
+
+	if r.Method == "POST" {
+		if !p.Batch {
+			http.Error(w, "batches not enabled", http.StatusMethodNotAllowed)
+			return
+		}
+		p.serveBatch(w, r)
+		return
+	}
+
 	// Parse request.
 	groupName := r.FormValue("group")
 	key := r.FormValue("key")
 
-	// Fetch the value for this group/key.
-	group := GetGroup(groupName)
-	if group == nil {
-		http.Error(w, "no such group: "+groupName, http.StatusNotFound)
+	if !p.begin(groupName, key) {
+		http.Error(w, "draining", http.StatusServiceUnavailable)
 		return
 	}
+	defer p.end(groupName, key)
+
 	var ctx Context
 	if p.Context != nil {
 		ctx = p.Context(r)
 	}
+	value, status, err := p.get(ctx, groupName, key)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	w.Write(value)
+}
+
+// begin accounts for a request from a peer for group/key, unless draining.
+func (p *PeersPool) begin(group, key string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.draining {
+		return false
+	}
+	p.inflight.Add(1)
+	if p.serving == nil {
+		p.serving = make(map[groupKey]int)
+	}
+	p.serving[groupKey{group, key}]++
+	p.load++
+	return true
+}
 
+// end accounts for the end of a request begun.
+func (p *PeersPool) end(group, key string) {
+	p.mu.Lock()
+	if p.serving[groupKey{group, key}]--; p.serving[groupKey{group, key}] == 0 {
+		delete(p.serving, groupKey{group, key})
+	}
+	p.load--
+	p.mu.Unlock()
+	p.inflight.Done()
+}
+
+// get fetches the value for group/key, as a GetResponse. On error, it also
+// returns the status to report it with.
+func (p *PeersPool) get(ctx Context, groupName, key string) (body []byte, status int, err error) {
+	group := GetGroup(groupName)
+	if group == nil {
+		return nil, http.StatusNotFound, fmt.Errorf("no such group: %s", groupName)
+	}
 	group.Stats.ServerRequests.Add(1)
 	var value []byte
 	if err := group.Get(ctx, key, AllocatingByteSliceSink(&value)); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return nil, http.StatusInternalServerError, err
 	}
-
-	// Write the value to the response body as a proto message.
-	body, err := proto.Marshal(&pb.GetResponse{Value: value})
+	body, err = proto.Marshal(&pb.GetResponse{Value: value})
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return nil, http.StatusInternalServerError, err
 	}
-	w.Header().Set("Content-Type", "application/x-protobuf")
-	w.Write(body)
+	return body, http.StatusOK, nil
 }
 
 type httpGetter struct {
 	transport func(Context) http.RoundTripper
 	baseURL   string
+	timeout   time.Duration
+	pool      *PeersPool
+	peer      string
+	// Set to batch the requests.
+	batcher *batcher
 }
 
 func (h *httpGetter) Get(context Context, in *pb.GetRequest, out *pb.GetResponse) (err error) {
+	// Only failures of the peer itself count against it, not errors
+	// fetching the value, which the peer reports with a status.
+	peerFailed := true
+	defer func() {
+		h.pool.report(h.peer, err, peerFailed)
+	}()
+	if h.batcher != nil {
+		err, peerFailed = h.batcher.Get(in, out)
+		return err
+	}
+
 	uu, err := url.Parse(h.baseURL)
 	if err != nil {
 		return err
@@ -161,27 +622,55 @@ func (h *httpGetter) Get(context Context, in *pb.GetRequest, out *pb.GetResponse
 	if err != nil {
 		return err
 	}
-	req.Close = true
+	req, conn := traceConn(req)
 	tr := http.DefaultTransport
 	if h.transport != nil {
 		tr = h.transport(context)
 	}
-	res, err := tr.RoundTrip(req)
+	client := &http.Client{Transport: tr, Timeout: h.timeout}
+	res, err := client.Do(req)
 	if err != nil {
+		peerFailed = !conn.loading(err)
 		return err
 	}
 	defer res.Body.Close()
 	if res.StatusCode != http.StatusOK {
+		// Draining peers refuse requests.
+		peerFailed = res.StatusCode == http.StatusServiceUnavailable
 		return fmt.Errorf("server returned: %v", res.Status)
 	}
 	// TODO: avoid this garbage.
 	b, err := ioutil.ReadAll(res.Body)
 	if err != nil {
+		peerFailed = !conn.loading(err)
 		return fmt.Errorf("reading response body: %v", err)
 	}
 	err = proto.Unmarshal(b, out)
 	if err != nil {
 		return fmt.Errorf("decoding response body: %v", err)
 	}
+	peerFailed = false
 	return nil
 }
+
+// peerConn tells whether a request got a connection to the peer.
+type peerConn struct {
+	connected int32
+}
+
+// traceConn returns req traced by a peerConn.
+func traceConn(req *http.Request) (*http.Request, *peerConn) {
+	c := new(peerConn)
+	trace := &httptrace.ClientTrace{
+		GotConn: func(httptrace.GotConnInfo) { atomic.StoreInt32(&c.connected, 1) },
+	}
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), trace)), c
+}
+
+// loading tells whether err is a timeout once connected to the peer. The
+// peer is up then, only still loading the value, which isn't held against
+// it by the breaker.
+func (c *peerConn) loading(err error) bool {
+	e, ok := err.(net.Error)
+	return ok && e.Timeout() && atomic.LoadInt32(&c.connected) != 0
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"net/url"
+	"sort"
+)
+
+// Width of the /image variant hashes are computed from.
+const phashSourceWidth = 128
+
+// hashes holds 64-bit perceptual hashes in hex.
+type hashes struct {
+	AHash, DHash, PHash string
+}
+
+type PHashFetcher struct {
+	DumpContentResponse
+}
+
+func (p PHashFetcher) Generate(query url.Values) (content []byte, err error) {
+	m, err := cachedImage(query.Get("url"), phashSourceWidth)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(hashes{
+		AHash: fmt.Sprintf("%016x", aHash(m)),
+		DHash: fmt.Sprintf("%016x", dHash(m)),
+		PHash: fmt.Sprintf("%016x", pHash(m)),
+	})
+}
+
+// grayPixels scales m to w*h and returns its luma, row by row.
+func grayPixels(m image.Image, w, h int) []float64 {
+	small := Resize(m, m.Bounds(), w, h)
+	ret := make([]float64, 0, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			ret = append(ret, float64(color.GrayModel.Convert(small.At(x, y)).(color.Gray).Y))
+		}
+	}
+	return ret
+}
+
+// aHash sets a bit for every pixel of an 8x8 thumbnail brighter than the mean.
+func aHash(m image.Image) (hash uint64) {
+	px := grayPixels(m, 8, 8)
+	var mean float64
+	for _, v := range px {
+		mean += v
+	}
+	mean /= float64(len(px))
+	for i, v := range px {
+		if v > mean {
+			hash |= 1 << uint(i)
+		}
+	}
+	return
+}
+
+// dHash sets a bit for every pixel of a 9x8 thumbnail brighter than its right neighbour.
+func dHash(m image.Image) (hash uint64) {
+	px := grayPixels(m, 9, 8)
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			if px[9*y+x] > px[9*y+x+1] {
+				hash |= 1 << uint(8*y+x)
+			}
+		}
+	}
+	return
+}
+
+// pHash sets a bit for every low frequency DCT coefficient of a 32x32
+// thumbnail above the median, taking the top-left 8x8 coefficients.
+func pHash(m image.Image) (hash uint64) {
+	const n, k = 32, 8
+	px := grayPixels(m, n, n)
+	var cos [k][n]float64
+	for u := 0; u < k; u++ {
+		for x := 0; x < n; x++ {
+			cos[u][x] = math.Cos(float64(2*x+1) * float64(u) * math.Pi / (2 * n))
+		}
+	}
+	// Rows first, then columns; only the k lowest frequencies are needed.
+	var rows [n][k]float64
+	for y := 0; y < n; y++ {
+		for u := 0; u < k; u++ {
+			for x := 0; x < n; x++ {
+				rows[y][u] += px[n*y+x] * cos[u][x]
+			}
+		}
+	}
+	coeffs := make([]float64, 0, k*k)
+	for v := 0; v < k; v++ {
+		for u := 0; u < k; u++ {
+			var sum float64
+			for y := 0; y < n; y++ {
+				sum += rows[y][u] * cos[v][y]
+			}
+			coeffs = append(coeffs, sum)
+		}
+	}
+	// The DC term is the overall brightness, leave it out of the median.
+	sorted := append([]float64(nil), coeffs[1:]...)
+	sort.Float64s(sorted)
+	median := sorted[len(sorted)/2]
+	for i, c := range coeffs {
+		if c > median {
+			hash |= 1 << uint(i)
+		}
+	}
+	return
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+)
+
+const (
+	// Size of the first range requested by a RangeReader.
+	initialRangeSize = 16 << 10
+	// Ranges double in size up to this.
+	maxRangeSize = 1 << 20
+)
+
+// RangeReader reads a URL with Range requests, fetching more only as it is
+// read, so reading a header doesn't cost the whole download. The ranges
+// grow as reading goes on. If the server ignores ranges, the plain
+// response is streamed instead. Reading past the limit fails with a
+// ContentError.
+type RangeReader struct {
+	// Response to the first request, for its headers.
+	// Its Body must not be used.
+	Response *http.Response
+	// Total size of the content, or -1 if unknown.
+	Size int64
+
+	client *http.Client
+	url    string
+	max    int64
+	body   io.ReadCloser
+	offset int64
+	next   int64
+	// The server doesn't support ranges, body has the rest of the content.
+	whole bool
+}
+
+// NewRangeReader requests the first range of url, to read at most max
+// bytes of it, if max is positive.
+func NewRangeReader(client *http.Client, url string, max int64) (*RangeReader, error) {
+	r := &RangeReader{client: client, url: url, max: max, next: initialRangeSize, Size: -1}
+	resp, err := r.fetch()
+	if err != nil {
+		return nil, err
+	}
+	r.Response = resp
+	// Don't follow the redirects again for the next ranges.
+	r.url = resp.Request.URL.String()
+	if r.whole {
+		r.Size = resp.ContentLength
+	}
+	return r, nil
+}
+
+func (r *RangeReader) fetch() (*http.Response, error) {
+	req, err := http.NewRequest("GET", r.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	last := r.offset + r.next - 1
+	if r.max > 0 && last >= r.max {
+		last = r.max - 1
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", r.offset, last))
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		var first, last int64
+		var size string
+		_, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-%d/%s", &first, &last, &size)
+		if s, err := strconv.ParseInt(size, 10, 64); err == nil {
+			r.Size = s
+		}
+		if err != nil || first != r.offset {
+			resp.Body.Close()
+			return nil, fmt.Errorf("Bad Content-Range %q for URL: %s", resp.Header.Get("Content-Range"), r.url)
+		}
+		if r.next *= 2; r.next > maxRangeSize {
+			r.next = maxRangeSize
+		}
+	case http.StatusOK:
+		// Ranges are not supported, skip what was read already.
+		if _, err := io.CopyN(ioutil.Discard, resp.Body, r.offset); err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+		r.whole = true
+	case http.StatusRequestedRangeNotSatisfiable:
+		// The content ended exactly at the last range.
+		resp.Body.Close()
+		r.Size = r.offset
+		r.whole = true
+		resp.Body = ioutil.NopCloser(eofReader{})
+	default:
+		resp.Body.Close()
+		return nil, StatusCodeError{r.url, resp.StatusCode}
+	}
+	r.body = resp.Body
+	return resp, nil
+}
+
+func (r *RangeReader) Read(p []byte) (n int, err error) {
+	if r.Size >= 0 && r.offset >= r.Size {
+		return 0, io.EOF
+	}
+	if r.max > 0 {
+		if r.offset >= r.max {
+			return 0, ContentError{r.url, ContentTooLarge}
+		}
+		if left := r.max - r.offset; int64(len(p)) > left {
+			p = p[:left]
+		}
+	}
+	if r.body == nil {
+		if _, err := r.fetch(); err != nil {
+			return 0, err
+		}
+	}
+	n, err = r.body.Read(p)
+	r.offset += int64(n)
+	if err == io.EOF && !r.whole {
+		r.body.Close()
+		r.body = nil
+		err = nil
+	}
+	return
+}
+
+func (r *RangeReader) Close() error {
+	if r.body == nil {
+		return nil
+	}
+	return r.body.Close()
+}
+
+type eofReader struct{}
+
+func (eofReader) Read([]byte) (int, error) { return 0, io.EOF }
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func randomContent(n int) []byte {
+	b := make([]byte, n)
+	rand.New(rand.NewSource(1)).Read(b)
+	return b
+}
+
+// rangeServer serves content, recording the Range headers requested.
+func rangeServer(t *testing.T, handler func(w http.ResponseWriter, r *http.Request)) (*httptest.Server, *[]string) {
+	var ranges []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		handler(w, r)
+	}))
+	t.Cleanup(server.Close)
+	return server, &ranges
+}
+
+func readRange(t *testing.T, url string, max int64) (*RangeReader, []byte, error) {
+	r, err := NewRangeReader(http.DefaultClient, url, max)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	return r, b, err
+}
+
+func TestRangeReader(t *testing.T) {
+	content := randomContent(100000)
+	server, ranges := rangeServer(t, func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+	})
+	r, b, err := readRange(t, server.URL, 0)
+	if err != nil || !bytes.Equal(b, content) {
+		t.Fatalf("read %d bytes, %v", len(b), err)
+	}
+	if r.Size != int64(len(content)) {
+		t.Errorf("size %d, want %d", r.Size, len(content))
+	}
+	want := []string{"bytes=0-16383", "bytes=16384-49151", "bytes=49152-114687"}
+	if fmt.Sprint(*ranges) != fmt.Sprint(want) {
+		t.Errorf("requested %v, want %v", *ranges, want)
+	}
+}
+
+func TestRangeReaderIgnored(t *testing.T) {
+	content := randomContent(100000)
+	server, ranges := rangeServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", fmt.Sprint(len(content)))
+		w.Write(content)
+	})
+	r, b, err := readRange(t, server.URL, 0)
+	if err != nil || !bytes.Equal(b, content) {
+		t.Fatalf("read %d bytes, %v", len(b), err)
+	}
+	if r.Size != int64(len(content)) {
+		t.Errorf("size %d, want %d", r.Size, len(content))
+	}
+	if len(*ranges) != 1 {
+		t.Errorf("requested %v, want a single request", *ranges)
+	}
+}
+
+func TestRangeReaderUnknownSize(t *testing.T) {
+	// Ending exactly at a range, the next one is not satisfiable.
+	content := randomContent(16<<10 + 32<<10)
+	server, ranges := rangeServer(t, func(w http.ResponseWriter, r *http.Request) {
+		var first, last int
+		fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &first, &last)
+		if first >= len(content) {
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		if last >= len(content) {
+			last = len(content) - 1
+		}
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/*", first, last))
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(content[first : last+1])
+	})
+	r, b, err := readRange(t, server.URL, 0)
+	if err != nil || !bytes.Equal(b, content) {
+		t.Fatalf("read %d bytes, %v", len(b), err)
+	}
+	if r.Size != int64(len(content)) {
+		t.Errorf("size %d, want %d", r.Size, len(content))
+	}
+	if len(*ranges) != 3 {
+		t.Errorf("requested %v, want 3 ranges", *ranges)
+	}
+}
+
+func TestRangeReaderLimit(t *testing.T) {
+	content := randomContent(100000)
+	for _, ignore := range []bool{false, true} {
+		server, ranges := rangeServer(t, func(w http.ResponseWriter, r *http.Request) {
+			if ignore {
+				r.Header.Del("Range")
+			}
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+		})
+		_, b, err := readRange(t, server.URL, 20000)
+		if _, ok := err.(ContentError); !ok {
+			t.Errorf("ranges ignored %v: got %v, want a ContentError", ignore, err)
+		}
+		if len(b) != 20000 {
+			t.Errorf("ranges ignored %v: read %d bytes, want 20000", ignore, len(b))
+		}
+		if !ignore && (*ranges)[len(*ranges)-1] != "bytes=16384-19999" {
+			t.Errorf("requested %v past the limit", *ranges)
+		}
+	}
+}
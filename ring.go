@@ -0,0 +1,89 @@
+package main
+
+import (
+	"hash/crc32"
+	"sort"
+	"strconv"
+)
+
+// Ring is a consistent hash of weighted nodes. A node of weight n has n
+// times the points of a node of weight 1, and owns about n times the keys.
+// With weight 1 it hashes like a consistenthash.Map of as many replicas.
+type Ring struct {
+	replicas int
+	hashes   []uint32
+	nodes    map[uint32]string
+}
+
+func NewRing(replicas int) *Ring {
+	return &Ring{replicas: replicas, nodes: make(map[uint32]string)}
+}
+
+func (r *Ring) IsEmpty() bool {
+	return len(r.hashes) == 0
+}
+
+// Add adds a node with weight, at least 1.
+func (r *Ring) Add(node string, weight int) {
+	if weight < 1 {
+		weight = 1
+	}
+	for i := 0; i < r.replicas*weight; i++ {
+		h := crc32.ChecksumIEEE([]byte(strconv.Itoa(i) + node))
+		r.hashes = append(r.hashes, h)
+		r.nodes[h] = node
+	}
+	sort.Slice(r.hashes, func(i, j int) bool { return r.hashes[i] < r.hashes[j] })
+}
+
+// index returns the index of the first point owning key.
+func (r *Ring) index(key string) int {
+	h := crc32.ChecksumIEEE([]byte(key))
+	i := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= h })
+	if i == len(r.hashes) {
+		i = 0
+	}
+	return i
+}
+
+// Get returns the node owning key.
+func (r *Ring) Get(key string) string {
+	if r.IsEmpty() {
+		return ""
+	}
+	return r.nodes[r.hashes[r.index(key)]]
+}
+
+// Shares returns the part of the key space owned by each node, from 0 to 1.
+func (r *Ring) Shares() map[string]float64 {
+	shares := make(map[string]float64)
+	for i, h := range r.hashes {
+		// A point owns the hashes since the previous one.
+		prev := r.hashes[(i+len(r.hashes)-1)%len(r.hashes)]
+		shares[r.nodes[h]] += float64(h-prev) / (1 << 32)
+	}
+	if len(r.hashes) == 1 {
+		shares[r.nodes[r.hashes[0]]] = 1
+	}
+	return shares
+}
+
+// Walk calls fn with the nodes in the order they would own key if the
+// previous ones were gone, the owner first, until fn returns false.
+func (r *Ring) Walk(key string, fn func(node string) bool) {
+	if r.IsEmpty() {
+		return
+	}
+	seen := make(map[string]bool)
+	start := r.index(key)
+	for i := 0; i < len(r.hashes); i++ {
+		node := r.nodes[r.hashes[(start+i)%len(r.hashes)]]
+		if seen[node] {
+			continue
+		}
+		seen[node] = true
+		if !fn(node) {
+			return
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+// spillPool returns a pool of this node and 3 peers of weight 1, with the
+// loads given.
+func spillPool(loads map[string]int, self int) *PeersPool {
+	p := &PeersPool{basePath: defaultBasePath, replicas: defaultReplicas, self: "http://self", LoadFactor: 1.25}
+	peers := map[string]PeerInfo{p.self: {Weight: 1}}
+	for _, peer := range []string{"http://a", "http://b", "http://c"} {
+		peers[peer] = PeerInfo{Weight: 1, Load: loads[peer]}
+	}
+	p.Update(peers)
+	p.load = self
+	return p
+}
+
+// pickAll picks the owners of n keys, counting them by node.
+func pickAll(p *PeersPool, n int) map[string]int {
+	picked := make(map[string]int)
+	for i := 0; i < n; i++ {
+		key := fmt.Sprint("key", i)
+		getter, ok := p.pick("group", key)
+		if !ok {
+			picked[p.self]++
+			continue
+		}
+		peer := getter.(*httpGetter).peer
+		picked[peer]++
+		// Done at once, not to add to the load.
+		p.report(peer, nil, false)
+	}
+	return picked
+}
+
+func TestSpill(t *testing.T) {
+	// Balanced loads leave the keys with their owners.
+	p := spillPool(map[string]int{"http://a": 10, "http://b": 10, "http://c": 10}, 10)
+	want := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		want[p.peers.Get(fmt.Sprint("key", i))]++
+	}
+	if got := pickAll(p, 1000); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("balanced: picked %v, want the owners %v", got, want)
+	}
+	for peer, stats := range p.Stats() {
+		if stats.Spilled != 0 {
+			t.Errorf("balanced: %s spilled %d", peer, stats.Spilled)
+		}
+	}
+
+	// Above the load factor, a peer's keys go to the next ones.
+	p = spillPool(map[string]int{"http://a": 100}, 0)
+	owned := 0
+	for i := 0; i < 1000; i++ {
+		if p.peers.Get(fmt.Sprint("key", i)) == "http://a" {
+			owned++
+		}
+	}
+	if got := pickAll(p, 1000); got["http://a"] != 0 {
+		t.Errorf("loaded: %d keys picked the loaded peer", got["http://a"])
+	}
+	if spilled := p.Stats()["http://a"].Spilled; spilled != int64(owned) {
+		t.Errorf("loaded: %d keys spilled, want the %d owned", spilled, owned)
+	}
+
+	// Keys this node owns spill too, but aren't counted as a peer's.
+	p = spillPool(nil, 100)
+	if got := pickAll(p, 1000); got[p.self] != 0 {
+		t.Errorf("loaded self: %d keys kept", got[p.self])
+	}
+	if _, ok := p.Stats()[p.self]; ok {
+		t.Error("stats of this node reported as a peer's")
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+const (
+	defaultPeerIdleConns = 16
+	// How long idle connections between peers are kept.
+	peerIdleTimeout = 90 * time.Second
+)
+
+// NewPeerTransport returns the transport for the traffic between peers,
+// which keeps idle connections to each peer for reuse, whatever the
+// keep-alive setting of the fetches. With HTTP2 set, it speaks HTTP/2 over
+// a single connection to each peer, in cleartext (h2c) unless with mutual
+// TLS.
+func NewPeerTransport(c ClusterConfig, auth *PeerAuth) http.RoundTripper {
+	if c.HTTP2 && auth.client == nil {
+		return auth.Wrap(&http2.Transport{
+			AllowHTTP: true,
+			DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+				return net.DialTimeout(network, addr, pingTimeout)
+			},
+		})
+	}
+	idle := c.PeerIdleConns
+	if idle <= 0 {
+		idle = defaultPeerIdleConns
+	}
+	return auth.Wrap(&http.Transport{
+		Dial: (&net.Dialer{
+			Timeout:   pingTimeout,
+			KeepAlive: 30 * time.Second,
+		}).Dial,
+		TLSClientConfig:     auth.client,
+		MaxIdleConnsPerHost: idle,
+		IdleConnTimeout:     peerIdleTimeout,
+		ForceAttemptHTTP2:   c.HTTP2,
+	})
+}
+
+// configurePeerServer lets server speak HTTP/2 to the peers if enabled.
+// HTTP/1 is still served to the others.
+func configurePeerServer(server *http.Server, c ClusterConfig) error {
+	if !c.HTTP2 {
+		return nil
+	}
+	if server.TLSConfig != nil {
+		return http2.ConfigureServer(server, nil)
+	}
+	handler := server.Handler
+	if handler == nil {
+		handler = http.DefaultServeMux
+	}
+	server.Handler = h2c.NewHandler(handler, new(http2.Server))
+	return nil
+}
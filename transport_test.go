@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang/groupcache"
+	pb "github.com/golang/groupcache/groupcachepb"
+	"github.com/golang/protobuf/proto"
+)
+
+// BenchmarkPeerGet gets values from a peer with parallel callers, reporting
+// the mean latency of a get, over the transports between peers.
+func BenchmarkPeerGet(b *testing.B) {
+	value, err := proto.Marshal(&pb.GetResponse{Value: make([]byte, 4096)})
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, bench := range []struct {
+		name    string
+		cluster ClusterConfig
+		// Builds the transport, nil for NewPeerTransport.
+		transport func() http.RoundTripper
+	}{
+		// A connection per request, as when requests were sent with Close.
+		{"close", ClusterConfig{}, func() http.RoundTripper {
+			return &http.Transport{DisableKeepAlives: true}
+		}},
+		{"pooled", ClusterConfig{}, nil},
+		{"h2c", ClusterConfig{HTTP2: true}, nil},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/x-protobuf")
+				w.Write(value)
+			}))
+			if err := configurePeerServer(server.Config, bench.cluster); err != nil {
+				b.Fatal(err)
+			}
+			server.Start()
+			defer server.Close()
+
+			var tr http.RoundTripper
+			if bench.transport != nil {
+				tr = bench.transport()
+			} else {
+				tr = NewPeerTransport(bench.cluster, new(PeerAuth))
+			}
+			getter := &httpGetter{
+				transport: func(groupcache.Context) http.RoundTripper { return tr },
+				baseURL:   server.URL + defaultBasePath,
+				timeout:   10 * time.Second,
+				pool:      new(PeersPool),
+				peer:      server.URL,
+			}
+			var latency int64
+			b.SetParallelism(4)
+			b.ResetTimer()
+			b.RunParallel(func(next *testing.PB) {
+				in := &pb.GetRequest{Group: proto.String("bench"), Key: proto.String("key")}
+				for next.Next() {
+					start := time.Now()
+					if err := getter.Get(nil, in, new(pb.GetResponse)); err != nil {
+						b.Error(err)
+						return
+					}
+					atomic.AddInt64(&latency, int64(time.Since(start)))
+				}
+			})
+			b.ReportMetric(float64(latency)/float64(b.N)/1e6, "ms/get")
+		})
+	}
+}